@@ -1,9 +1,11 @@
 package backup
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,27 +17,83 @@ import (
 	"github.com/bndr/gotabulate"
 )
 
+// 由main设置，写入manifest中
+var (
+	Version string
+	Githash string
+)
+
 type Backup struct {
 	conf      *config.Config
 	partition string
+	since     string //cponly为false时，分区的下限
 	cponly    bool
+	dryrun    bool
 	states    map[string]*State
+	catalog   []CatalogEntry
+	run       string      //本次运行的ID，备份保存在该run下
+	snapshot  string      //恢复或删除时指定的run，为空表示恢复最新的备份，删除所有备份
+	reshard   *ch.Reshard //不为空时重新分片恢复
+	atomic    bool        //先恢复到影子表，再通过REPLACE PARTITION替换目标表中的分区
+	force     bool        //目标表中的分区不为空时仍然恢复
+	ctx       context.Context
+	journal   *Journal //备份时每个表分区的状态，用于继续中断的运行
 	reporter  string
 	cwd       string
 }
 
 func NewBack(conf *config.Config, op_type, partition, cwd string, cponly bool) *Backup {
 	os.Mkdir(path.Join(cwd, "reporter"), 0644)
+	run := ch.NewRun()
 	return &Backup{
 		conf:      conf,
 		partition: partition,
 		cponly:    cponly,
 		states:    make(map[string]*State),
+		run:       run,
+		ctx:       context.Background(),
+		journal:   newJournal(cwd, op_type, run),
 		cwd:       cwd,
 		reporter:  fmt.Sprintf(path.Join(cwd, "reporter/%s_%s.out"), op_type, time.Now().Format("20060102T15:04:05")),
 	}
 }
 
+// 继续之前中断的备份，使用该run的journal中记录的分区，跳过已经完成的表分区，备份仍然保存在该run下
+func (this *Backup) Resume(run string) error {
+	j, err := loadJournal(this.cwd, constant.OP_TYPE_BACKUP, run)
+	if err != nil {
+		return err
+	}
+	this.journal = j
+	this.run = j.Run
+	this.partition = j.Partition
+	this.since = j.Since
+	this.cponly = j.Cponly
+	log.Logger.Infof("resume run %s, attempt %d, partition: %s", j.Run, j.Attempt, j.Partition)
+	return nil
+}
+
+// 设置分区下限，只处理大于等于since的分区，仅在不指定分区时有效
+func (this *Backup) SetSince(since string) {
+	this.since = since
+}
+
+// 指定恢复或删除的备份
+func (this *Backup) SetSnapshot(snapshot string) {
+	this.snapshot = snapshot
+}
+
+// 设置恢复方式，atomic为true时通过影子表原子替换分区，force为true时目标分区不为空也恢复
+func (this *Backup) SetRestoreMode(atomic, force bool) {
+	this.atomic = atomic
+	this.force = force
+}
+
+// 设置取消操作的context，需要在Init之前调用，取消后不再开始新的表和分区，正在执行的操作会被终止
+func (this *Backup) SetContext(ctx context.Context) {
+	this.ctx = ctx
+}
+
 // 初始化备份条件，创建clickhouse连接，检查S3有效性
 func (this *Backup) Init() error {
 	err := s3client.NewSession(&this.conf.S3Disk)
@@ -43,87 +101,521 @@ func (this *Backup) Init() error {
 		return err
 	}
 
-	return ch.Connect(this.conf.ClickHouse)
+	return ch.Connect(this.ctx, this.conf.ClickHouse)
 }
 
-// 具体的备份操作
+// 具体的备份操作，按照并发限制同时备份多个表分区，从大到小调度
 func (this *Backup) Do() error {
+	this.journal.Partition, this.journal.Since, this.journal.Cponly = this.partition, this.since, this.cponly
+	units, err := this.backupUnits()
+	if err != nil {
+		if this.ctx.Err() != nil {
+			// 还没有开始备份，已经统计过的表都被取消
+			for _, state := range this.states {
+				state.Cancel(err)
+			}
+		}
+		return err
+	}
+	sortUnits(units)
+	log.Logger.Infof("backup %d partitions of %d tables, concurrency: %+v", len(units), len(this.conf.ClickHouse.Tables), this.conf.Concurrency)
+
+	skipped := newScheduler(this.conf.Concurrency).run(this.ctx, units, func(seq int, u *unit) {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, u.table)
+		log.Logger.Infof("(%d/%d) table %s [%s] backup, size: %s", seq, len(units), statekey, u.partition, formatReadableSize(u.size))
+		this.journal.transit(statekey, u.partition, UNIT_RUNNING, nil)
+		if err := this.backupPartition(u.table, u.partition); err != nil {
+			this.failure(statekey, err)
+			if this.ctx.Err() != nil {
+				this.journal.transit(statekey, u.partition, UNIT_CANCELLED, err)
+			} else {
+				this.journal.transit(statekey, u.partition, UNIT_FAILED, err)
+			}
+			return
+		}
+		this.journal.transit(statekey, u.partition, UNIT_DONE, nil)
+	})
+	for _, u := range skipped {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, u.table)
+		log.Logger.Warnf("table %s [%s] is not backup: %v", statekey, u.partition, this.ctx.Err())
+		this.states[statekey].Cancel(fmt.Errorf("partition %s is not backup: %w", u.partition, this.ctx.Err()))
+	}
+
+	for _, table := range this.conf.ClickHouse.Tables {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		if !this.states[statekey].Failed() {
+			this.states[statekey].Success()
+		}
+		this.journal.finish(statekey, this.states[statekey])
+		log.Logger.Infof("backup table %s done", statekey)
+	}
+	this.journal.removeIfDone()
+	return nil
+}
+
+// 统计需要备份的表，每个表分区为一个调度单元
+func (this *Backup) backupUnits() ([]*unit, error) {
+	pinned, err := unfinishedCleans(this.cwd, constant.OP_TYPE_BACKUP, this.run)
+	if err != nil {
+		return nil, err
+	}
+	var units []*unit
 	for _, table := range this.conf.ClickHouse.Tables {
 		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
-		rows, err := ch.Rows(this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+		if t := this.journal.table(statekey); t != nil {
+			// 之前的尝试中已经统计过，不再查询clickhouse，只调度没有完成的分区
+			this.states[statekey] = NewState(t.Rows, t.UncompressedSize, t.CompressedSize, len(t.Partitions))
+			var rsize uint64
+			for p, u := range t.Partitions {
+				if u.State == UNIT_DONE {
+					rsize += u.RemoteSize
+					continue
+				}
+				if this.refuse(statekey, p, pinned) {
+					continue
+				}
+				// 只在之前没有校验成功的分片上重试，已经写入manifest的分区只需要清理本地数据
+				var hosts []string
+				if shards := this.pendingShards(statekey, p); len(shards) > 0 && u.State != UNIT_BACKED_UP {
+					if hosts, err = ch.PartitionHosts(this.ctx, this.conf.ClickHouse.Database, table, p, shards); err != nil {
+						return nil, err
+					}
+				}
+				units = append(units, &unit{table: table, partition: p, size: u.Size, hosts: hosts})
+			}
+			done := t.done()
+			this.states[statekey].Resume(t.Elapsed, rsize, done)
+			log.Logger.Infof("table %s resumed, %d partitions done before, %d left", statekey, len(done), len(t.Partitions)-len(done))
+			continue
+		}
+		rows, err := ch.Rows(this.ctx, this.conf.ClickHouse.Database, table, this.partition, this.cponly)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		buncsize, bczise, err := ch.Size(this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+		buncsize, bczise, err := ch.Size(this.ctx, this.conf.ClickHouse.Database, table, this.partition, this.cponly)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		var partitions []string
-		if this.cponly {
-			partitions = strings.Split(this.partition, ",")
-		} else {
-			partitions, err = ch.Partitions(this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+		partitions, err := this.partitions(table)
+		if err != nil {
+			return nil, err
+		}
+		this.states[statekey] = NewState(rows, buncsize, bczise, len(partitions))
+		var tableUnits []*unit
+		for _, p := range partitions {
+			if this.refuse(statekey, p, pinned) {
+				continue
+			}
+			_, size, err := ch.Size(this.ctx, this.conf.ClickHouse.Database, table, p, true)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			hosts, err := ch.PartitionHosts(this.ctx, this.conf.ClickHouse.Database, table, p, nil)
+			if err != nil {
+				return nil, err
 			}
+			tableUnits = append(tableUnits, &unit{table: table, partition: p, size: size, hosts: hosts})
+		}
+		this.journal.addTable(statekey, rows, buncsize, bczise, tableUnits)
+		units = append(units, tableUnits...)
+	}
+	return units, nil
+}
+
+// 其他run中已经删除了部分分片本地数据的表分区，重新备份会生成一份缺少这些分片数据的备份，需要先通过--resume完成该run
+func (this *Backup) refuse(statekey, p string, pinned map[string]string) bool {
+	run, ok := pinned[fmt.Sprintf("%s/%s", statekey, p)]
+	if !ok {
+		return false
+	}
+	err := fmt.Errorf("partition %s has shards cleaned by unfinished run %s, resume with: ch2s3 backup --resume %s", p, run, run)
+	log.Logger.Errorf("table %s %v", statekey, err)
+	this.states[statekey].Failure(err)
+	return true
+}
+
+// 备份一个表分区，写入manifest后按照配置清理本地数据
+func (this *Backup) backupPartition(table, p string) error {
+	statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+	if this.journal.state(statekey, p) == UNIT_BACKED_UP {
+		// 之前的尝试中已经写入manifest，只需要清理本地数据
+		log.Logger.Infof("table %s partition %s already backup in previous attempt", statekey, p)
+		this.states[statekey].Set(constant.STATE_REMOTE_SIZE, this.journal.remoteSize(statekey, p))
+	} else if err := this.backupToS3(table, p); err != nil {
+		return err
+	}
+	if this.conf.ClickHouse.Clean {
+		var shards []int
+		for i := 0; i < ch.Shards(); i++ {
+			shards = append(shards, i)
+		}
+		this.cleanShards(table, p, shards)
+	}
+	return nil
+}
+
+// 之前的尝试中没有校验成功的分片，从0开始
+func (this *Backup) pendingShards(statekey, p string) []int {
+	verified := make(map[int]bool)
+	for _, shard := range this.journal.verifiedShards(statekey, p) {
+		verified[shard.Shard] = true
+	}
+	var shards []int
+	for i := 0; i < ch.Shards(); i++ {
+		if !verified[i] {
+			shards = append(shards, i)
+		}
+	}
+	return shards
+}
+
+// 清理指定分片的本地数据，跳过之前已经清理过的分片，清理失败只打印日志
+func (this *Backup) cleanShards(table, p string, shards []int) {
+	statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+	cleaned := this.journal.cleanedShards(statekey, p)
+	var todo []int
+	for _, shard := range shards {
+		if !cleaned[shard] {
+			todo = append(todo, shard)
+		}
+	}
+	if len(todo) == 0 {
+		return
+	}
+	if err := ch.Clean(this.ctx, this.conf.ClickHouse.Database, table, p, todo); err != nil {
+		log.Logger.Errorf("clean table %s partition %s failed: %v", statekey, p, err)
+		return
+	}
+	this.journal.cleaned(statekey, p, todo)
+}
+
+// 备份一个表分区到S3并写入manifest
+func (this *Backup) backupToS3(table, p string) error {
+	statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+	// 增量备份以该分区最新的一次备份为base，没有base时仍然做全量备份
+	var bases []*ch.Manifest
+	var err error
+	if this.conf.S3Disk.Incremental {
+		bases, err = this.latestChain(table, p)
+		if err != nil {
+			log.Logger.Errorf("table %s partition %s resolve base backup failed: %v", statekey, p, err)
+			return err
+		}
+		if len(bases) > 0 {
+			log.Logger.Infof("table %s partition %s incremental backup based on %s", statekey, p, bases[0].Key())
+		}
+	}
+	// 之前的尝试中已经校验成功的分片不再备份
+	shards := this.journal.verifiedShards(statekey, p)
+	var rsize uint64
+	for _, shard := range shards {
+		rsize += shard.RemoteSize
+	}
+	todo := this.pendingShards(statekey, p)
+	if len(shards) > 0 {
+		log.Logger.Infof("table %s partition %s has %d shards verified in previous attempt, backup shards %v only", statekey, p, len(shards), todo)
+	}
+	var results []ch.ShardResult
+	if len(todo) > 0 {
+		// shards为空时Ch2S3会备份所有分片，所有分片都已经校验成功时只需要写入manifest
+		results, err = ch.Ch2S3(this.ctx, this.conf.ClickHouse.Database, table, p, this.run, todo, bases, this.conf.S3Disk, this.cwd)
+	}
+	var done []int
+	for _, shard := range shards {
+		done = append(done, shard.Shard)
+	}
+	for _, r := range results {
+		rsize += r.RemoteSize
+		this.states[statekey].Shard(p, r)
+		this.journal.shardResult(statekey, p, r)
+		if r.Err == nil && r.Manifest != nil {
+			shards = append(shards, *r.Manifest)
+			done = append(done, r.Shard)
+		}
+	}
+	this.states[statekey].Set(constant.STATE_REMOTE_SIZE, rsize)
+	if err != nil {
+		log.Logger.Errorf("table %s partition %s backup failed: %v", statekey, p, err)
+		if this.conf.ClickHouse.CleanShards && len(done) > 0 {
+			// 部分分片失败时只清理已经校验成功的分片，这些分片的数据只存在于本次run中，只能通过--resume继续完成
+			this.cleanShards(table, p, done)
+		}
+		return err
+	}
+	if err = this.writeManifest(table, p, this.run, bases, shards); err != nil {
+		log.Logger.Errorf("table %s partition %s write manifest failed: %v", statekey, p, err)
+		return err
+	}
+	this.journal.backedUp(statekey, p, rsize)
+	return nil
+}
+
+// 校验已经备份到S3上的数据与本地数据是否一致
+func (this *Backup) Verify() error {
+	if this.conf.S3Disk.VerifyMode == constant.VERIFY_MODE_BACKUP {
+		return this.verifyBackup()
+	}
+	for _, table := range this.conf.ClickHouse.Tables {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		if this.cancelled(statekey) {
+			continue
+		}
+		rows, err := ch.Rows(this.ctx, this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+		if err != nil {
+			return err
+		}
+		buncsize, bczise, err := ch.Size(this.ctx, this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+		if err != nil {
+			return err
+		}
+		partitions, err := this.partitions(table)
+		if err != nil {
+			return err
 		}
 		this.states[statekey] = NewState(rows, buncsize, bczise, len(partitions))
 		ok := true
 		for i, p := range partitions {
-			log.Logger.Infof("(%d/%d) table %s [%s] backup ", i+1, len(partitions), statekey, p)
-			rsize, err := ch.Ch2S3(this.conf.ClickHouse.Database, table, p, this.conf.S3Disk, this.cwd)
-			this.states[statekey].Set(constant.STATE_REMOTE_SIZE, rsize)
+			if this.cancelled(statekey) {
+				ok = false
+				break
+			}
+			log.Logger.Infof("(%d/%d) table %s [%s] verify ", i+1, len(partitions), statekey, p)
+			chain, err := this.latestChain(table, p)
 			if err != nil {
-				log.Logger.Errorf("table %s partition %s backup failed: %v", statekey, p, err)
-				this.states[statekey].Failure(err)
+				log.Logger.Errorf("table %s partition %s resolve backup chain failed: %v", statekey, p, err)
+				this.failure(statekey, err)
 				ok = false
 				continue
 			}
-			if this.conf.ClickHouse.Clean {
-				err = ch.Clean(this.conf.ClickHouse.Database, table, p)
-				if err != nil {
-					log.Logger.Errorf("clean table %s partition %s failed: %v", statekey, p, err)
-				}
+			rsize, err := ch.Verify(this.ctx, this.conf.ClickHouse.Database, table, p, chain, this.conf.S3Disk, this.cwd)
+			this.states[statekey].Set(constant.STATE_REMOTE_SIZE, rsize)
+			if err != nil {
+				log.Logger.Errorf("table %s partition %s verify failed: %v", statekey, p, err)
+				this.failure(statekey, err)
+				ok = false
 			}
 		}
 		if ok {
 			this.states[statekey].Success()
 		}
-		log.Logger.Infof("backup table %s done", statekey)
+		log.Logger.Infof("verify table %s done", statekey)
+	}
+	return nil
+}
+
+// 删除S3上的备份数据，dryrun时只打印需要删除的数据
+func (this *Backup) Delete(dryrun bool) error {
+	this.dryrun = dryrun
+	for _, table := range this.conf.ClickHouse.Tables {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		if this.cancelled(statekey) {
+			continue
+		}
+		partitions, err := this.remotePartitions(table)
+		if err != nil {
+			return err
+		}
+		this.states[statekey] = NewState(0, 0, 0, len(partitions))
+		if err = this.removePartitions(table, partitions); err != nil {
+			this.failure(statekey, err)
+		} else {
+			this.states[statekey].Success()
+		}
+		log.Logger.Infof("delete table %s done", statekey)
+	}
+	return nil
+}
+
+// 按照配置的保留策略删除S3上过期的备份，dryrun时只打印删除计划
+func (this *Backup) Prune(dryrun bool) error {
+	this.dryrun = dryrun
+	for _, table := range this.conf.ClickHouse.Tables {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		if this.cancelled(statekey) {
+			continue
+		}
+		policy := this.conf.Retention.For(table)
+		if policy.Empty() {
+			log.Logger.Infof("table %s has no retention policy, skip prune", statekey)
+			this.states[statekey] = NewState(0, 0, 0, 0)
+			this.states[statekey].Success()
+			continue
+		}
+		partitions, err := this.remotePartitions(table)
+		if err != nil {
+			return err
+		}
+		expired, skipped := retentionPlan(partitions, policy, time.Now())
+		if len(skipped) > 0 {
+			log.Logger.Warnf("table %s partitions %v are not date, never prune", statekey, skipped)
+		}
+		log.Logger.Infof("table %s retention policy: %+v, %d partitions on s3, %d expired: %v",
+			statekey, policy, len(partitions), len(expired), expired)
+		this.states[statekey] = NewState(0, 0, 0, len(expired))
+		if err = this.removePartitions(table, expired); err != nil {
+			this.failure(statekey, err)
+		} else {
+			this.states[statekey].Success()
+		}
+		log.Logger.Infof("prune table %s done", statekey)
+	}
+	return nil
+}
+
+// 删除S3上指定分区的备份，并记录到state中，仍被其他增量备份依赖的分区不删除
+func (this *Backup) removePartitions(table string, partitions []string) error {
+	statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+	inUse, err := this.basesInUse(table, partitions)
+	if err != nil {
+		return err
+	}
+	for i, p := range partitions {
+		if err := this.ctx.Err(); err != nil {
+			return err
+		}
+		if by, ok := inUse[p]; ok {
+			log.Logger.Warnf("table %s partition %s is base of incremental backup %s, refuse to delete", statekey, p, by)
+			continue
+		}
+		key := ch.PartitionDir(this.conf.ClickHouse.Database, table, p)
+		deleted := p
+		if this.snapshot != "" {
+			key += this.snapshot + "/"
+			deleted = fmt.Sprintf("%s/%s", p, this.snapshot)
+		}
+		objects, err := s3client.List(this.ctx, this.conf.S3Disk.Bucket, key)
+		if err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		var rsize uint64
+		for _, object := range objects {
+			rsize += uint64(*object.Size)
+		}
+		log.Logger.Infof("(%d/%d) table %s [%s] delete %d objects, %s", i+1, len(partitions), statekey, p, len(objects), formatReadableSize(rsize))
+		if !this.dryrun {
+			if err = s3client.Remove(this.ctx, this.conf.S3Disk.Bucket, key, this.conf.S3Disk.DeleteWorkers); err != nil {
+				log.Logger.Errorf("table %s partition %s delete failed: %v", statekey, p, err)
+				return err
+			}
+		}
+		this.states[statekey].Set(constant.STATE_REMOTE_SIZE, rsize)
+		this.states[statekey].Deleted(deleted)
 	}
+	return nil
+}
 
+// 检查配置的clickhouse集群和S3是否可用
+func (this *Backup) Check() error {
+	var failed int
+	var data [][]interface{}
+	data = append(data, []interface{}{"host", "item", "result"})
+	err := s3client.CheckBucket(this.ctx, this.conf.S3Disk.Bucket)
+	if err != nil {
+		failed++
+	}
+	data = append(data, []interface{}{this.conf.S3Disk.Endpoint, "s3", result(err)})
+	for _, item := range ch.Check(this.ctx, this.conf.ClickHouse.Database, this.conf.ClickHouse.Tables, this.conf.S3Disk.VerifyMode == constant.VERIFY_MODE_LOCAL) {
+		if item.Err != nil {
+			failed++
+		}
+		data = append(data, []interface{}{item.Host, item.Item, result(item.Err)})
+	}
+	tabulate := gotabulate.Create(data)
+	fmt.Print(tabulate.Render("grid"))
+	if failed > 0 {
+		return fmt.Errorf("%d check items failed", failed)
+	}
 	return nil
 }
 
-// 备份表只能一个partition一个partition的备份，因为无法查询出全量的partition了
+// 原表中已经查询不到需要恢复的分区，未指定分区时从S3上的备份中查找
 func (this *Backup) Restore() error {
-	var err error
 	for _, table := range this.conf.ClickHouse.Tables {
 		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		tdatabase, ttable := this.conf.ClickHouse.RestoreTarget(table)
+		if target := fmt.Sprintf("%s.%s", tdatabase, ttable); target != statekey {
+			log.Logger.Infof("table %s restore as %s", statekey, target)
+			statekey = fmt.Sprintf("%s -> %s", statekey, target)
+		}
+		if this.cancelled(statekey) {
+			continue
+		}
 		ok := true
-		partitions := strings.Split(this.partition, ",")
+		partitions, incomplete, err := this.restorePartitions(table)
+		if err != nil {
+			return err
+		}
 		this.states[statekey] = NewState(0, 0, 0, len(partitions))
+		if len(incomplete) > 0 {
+			err = fmt.Errorf("partitions %v are not backup completely on every shard, skipped", incomplete)
+			log.Logger.Warnf("table %s %v", statekey, err)
+			this.failure(statekey, err)
+			ok = false
+		}
+		if len(partitions) == 0 {
+			log.Logger.Warnf("table %s has no partition to restore", statekey)
+		}
 		var rows, buncsize, bcsize uint64
 		for i, p := range partitions {
+			if this.cancelled(statekey) {
+				ok = false
+				break
+			}
 			log.Logger.Infof("(%d/%d) table %s [%s] restore ", i+1, len(partitions), statekey, p)
-			err = ch.Restore(this.conf.ClickHouse.Database, table, p, this.conf.S3Disk)
+			chain, err := this.restoreChain(table, p)
 			if err != nil {
-				log.Logger.Errorf("table %s restore failed: %v", statekey, err)
-				this.states[statekey].Failure(err)
+				log.Logger.Errorf("table %s partition %s resolve backup chain failed: %v", statekey, p, err)
+				this.failure(statekey, err)
 				ok = false
 				break
 			}
-			row, err := ch.Rows(this.conf.ClickHouse.Database, table, p, true)
+			before, err := this.checkEmpty(tdatabase, ttable, p)
 			if err != nil {
+				log.Logger.Errorf("table %s %v", statekey, err)
+				this.failure(statekey, err)
+				ok = false
+				break
+			}
+			if this.reshard != nil {
+				err = this.reshardRestore(statekey, table, tdatabase, ttable, p, chain)
+			} else {
+				err = this.restorePartition(table, tdatabase, ttable, p, chain)
+			}
+			if err != nil {
+				log.Logger.Errorf("table %s partition %s restore failed: %v", statekey, p, err)
+				this.failure(statekey, err)
+				ok = false
+				break
+			}
+			row, err := ch.Rows(this.ctx, tdatabase, ttable, p, true)
+			if err != nil {
+				this.failure(statekey, err)
 				return err
 			}
-			bunc, bc, err := ch.Size(this.conf.ClickHouse.Database, table, p, true)
+			bunc, bc, err := ch.Size(this.ctx, tdatabase, ttable, p, true)
 			if err != nil {
+				this.failure(statekey, err)
 				return err
 			}
 			rows += row
 			buncsize += bunc
 			bcsize += bc
+			if this.reshard != nil {
+				err = this.verifyReshard(tdatabase, ttable, p, chain, sub(row, totalRows(before)))
+			} else {
+				err = this.verifyRestore(tdatabase, ttable, p, chain, before)
+			}
+			if err == nil {
+				// 每个分片的所有副本上的数据需要一致
+				err = ch.VerifyReplicas(this.ctx, tdatabase, ttable, p)
+			}
+			if err != nil {
+				this.failure(statekey, err)
+				ok = false
+			}
 		}
 
 		this.states[statekey].Set(constant.STATE_ROWS, rows)
@@ -137,16 +629,87 @@ func (this *Backup) Restore() error {
 	return nil
 }
 
+// 按照备份时的分片恢复一个分区，恢复到tdatabase.ttable中，目标表不存在时按照备份中的表结构创建
+func (this *Backup) restorePartition(table, tdatabase, ttable, partition string, chain []*ch.Manifest) error {
+	keys, err := this.restoreKeys(table, partition, chain)
+	if err != nil {
+		return err
+	}
+	if tdatabase != this.conf.ClickHouse.Database || ttable != table {
+		if err = ch.CreateRestoreTable(this.ctx, this.conf.ClickHouse.Database, table, tdatabase, ttable, keys, this.conf.S3Disk); err != nil {
+			return err
+		}
+	}
+	if this.atomic {
+		var expect []uint64
+		if len(chain) > 0 {
+			expect = make([]uint64, len(keys))
+			for i := range expect {
+				if i < len(chain[0].Shards) {
+					expect[i] = chain[0].Shards[i].Rows
+				}
+			}
+		}
+		return ch.AtomicRestore(this.ctx, this.conf.ClickHouse.Database, table, tdatabase, ttable, partition, this.run, keys, expect, this.conf.S3Disk)
+	}
+	return ch.Restore(this.ctx, this.conf.ClickHouse.Database, table, tdatabase, ttable, partition, keys, this.conf.S3Disk)
+}
+
+// 目标表中该分区已经有数据时，恢复会导致数据重复，需要指定force
+// 追加恢复时返回恢复前每个分片的统计信息，校验时只比对本次恢复的数据
+func (this *Backup) checkEmpty(database, table, partition string) ([]ch.ShardStat, error) {
+	stats, err := ch.PartitionStats(this.ctx, database, table, partition)
+	if err != nil {
+		return nil, err
+	}
+	rows := totalRows(stats)
+	if rows == 0 {
+		return nil, nil
+	}
+	if !this.force {
+		if this.atomic {
+			return nil, fmt.Errorf("partition %s of %s.%s is not empty (%d rows), use --force to replace it", partition, database, table, rows)
+		}
+		return nil, fmt.Errorf("partition %s of %s.%s is not empty (%d rows), restore would duplicate data, use --atomic --force to replace it, or --force to append", partition, database, table, rows)
+	}
+	if this.atomic {
+		log.Logger.Warnf("partition %s of %s.%s is not empty (%d rows), it will be replaced", partition, database, table, rows)
+		return nil, nil
+	}
+	log.Logger.Warnf("partition %s of %s.%s is not empty (%d rows), restored data will be appended", partition, database, table, rows)
+	return stats, nil
+}
+
+func totalRows(stats []ch.ShardStat) uint64 {
+	var rows uint64
+	for _, stat := range stats {
+		rows += stat.Rows
+	}
+	return rows
+}
+
 // 出具报表
 func (this *Backup) Repoter(op_type string) error {
 	f, err := os.OpenFile(this.reporter, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	var ok_tables, fail_tables, total_bytes uint64
+	var ok_tables, fail_tables, cancel_tables, total_bytes uint64
 	var all_costs int
 	defer f.Close()
-	_, err = f.WriteString(fmt.Sprintf("%s Date: %s\n\n", strings.Title(op_type), this.partition))
+	date := this.partition
+	if !this.cponly && this.since != "" {
+		date = fmt.Sprintf("%s ~ %s", this.since, this.partition)
+	}
+	if op_type == constant.OP_TYPE_BACKUP {
+		date = fmt.Sprintf("%s, Run: %s", date, this.run)
+		if this.journal.Attempt > 1 {
+			date = fmt.Sprintf("%s, Attempt: %d", date, this.journal.Attempt)
+		}
+	} else if this.snapshot != "" {
+		date = fmt.Sprintf("%s, Snapshot: %s", date, this.snapshot)
+	}
+	_, err = f.WriteString(fmt.Sprintf("%s Date: %s\n\n", strings.Title(op_type), date))
 	if err != nil {
 		return err
 	}
@@ -155,9 +718,12 @@ func (this *Backup) Repoter(op_type string) error {
 	data = append(data, []interface{}{"table", "rows", "size(uncompressed)", "size(compressed)", "remote_size", "partition", "elapsed", "status"})
 	for k, v := range this.states {
 		data = append(data, []interface{}{k, v.rows, formatReadableSize(v.buncsize), formatReadableSize(v.bcsize), formatReadableSize(v.rsize), v.partitions, v.elasped, status(v.extval)})
-		if v.extval == constant.BACKUP_SUCCESS {
+		switch v.extval {
+		case constant.BACKUP_SUCCESS:
 			ok_tables++
-		} else {
+		case constant.BACKUP_CANCELLED:
+			cancel_tables++
+		default:
 			fail_tables++
 		}
 		total_bytes += v.buncsize
@@ -165,7 +731,66 @@ func (this *Backup) Repoter(op_type string) error {
 	}
 	tabulate := gotabulate.Create(data)
 	f.WriteString(tabulate.Render("grid"))
-	f.WriteString(fmt.Sprintf("\nTotal Tables: %d,  Success Tables: %d,  Failed Tables: %d,  Total Bytes: %s,  Elapsed: %d sec\n", ok_tables+fail_tables, ok_tables, fail_tables, formatReadableSize(total_bytes), all_costs))
+	f.WriteString(fmt.Sprintf("\nTotal Tables: %d,  Success Tables: %d,  Failed Tables: %d,  Total Bytes: %s,  Elapsed: %d sec\n", ok_tables+fail_tables+cancel_tables, ok_tables, fail_tables, formatReadableSize(total_bytes), all_costs))
+	if cancel_tables > 0 {
+		f.WriteString(fmt.Sprintf("Cancelled Tables: %d, %s is interrupted by signal\n", cancel_tables, op_type))
+	}
+
+	title := "Deleted Partitions"
+	if this.dryrun {
+		title = "Partitions To Delete (dry run)"
+	}
+	deleted := false
+	for k, v := range this.states {
+		if len(v.deleted) == 0 {
+			continue
+		}
+		if !deleted {
+			f.WriteString(fmt.Sprintf("\n%s:\n", title))
+			deleted = true
+		}
+		f.WriteString(fmt.Sprintf("%s\n\t%s\n", k, strings.Join(v.deleted, ",")))
+	}
+
+	resumed := false
+	for k, v := range this.states {
+		if len(v.resumed) == 0 {
+			continue
+		}
+		if !resumed {
+			f.WriteString("\nPartitions Done In Previous Attempts:\n")
+			resumed = true
+		}
+		f.WriteString(fmt.Sprintf("%s\n\t%s\n", k, strings.Join(v.resumed, ",")))
+	}
+
+	for k, v := range this.states {
+		if len(v.progress) == 0 {
+			continue
+		}
+		var progress [][]interface{}
+		progress = append(progress, []interface{}{"partition", "source shard", "host", "rows", "elapsed", "status"})
+		for _, p := range v.progress {
+			progress = append(progress, []interface{}{p.partition, p.Shard, p.Host, p.Rows, fmt.Sprintf("%d sec", int(p.Elapsed.Seconds())), result(p.Err)})
+		}
+		f.WriteString(fmt.Sprintf("\nReshard Progress of %s:\n", k))
+		f.WriteString(gotabulate.Create(progress).Render("grid"))
+	}
+
+	for k, v := range this.states {
+		var shards [][]interface{}
+		shards = append(shards, []interface{}{"partition", "shard", "host", "error"})
+		for _, s := range v.shards {
+			if s.Err != nil {
+				shards = append(shards, []interface{}{s.partition, s.Shard + 1, s.Host, s.Err.Error()})
+			}
+		}
+		if len(shards) == 1 {
+			continue
+		}
+		f.WriteString(fmt.Sprintf("\nFailed Shards of %s:\n", k))
+		f.WriteString(gotabulate.Create(shards).Render("grid"))
+	}
 
 	if fail_tables > 0 {
 		f.WriteString("\nFailed Tables:\n")
@@ -178,6 +803,20 @@ func (this *Backup) Repoter(op_type string) error {
 			}
 		}
 	}
+	if cancel_tables > 0 {
+		f.WriteString("\nCancelled Tables:\n")
+		i := 1
+		for k, v := range this.states {
+			if v.extval == constant.BACKUP_CANCELLED {
+				f.WriteString(fmt.Sprintf("[%d]%s\n", i, k))
+				f.WriteString(fmt.Sprintf("\t%v\n", v.why))
+				i++
+			}
+		}
+	}
+	if op_type == constant.OP_TYPE_BACKUP && fail_tables+cancel_tables > 0 {
+		f.WriteString(fmt.Sprintf("\nJournal: %s, resume with: ch2s3 backup --resume %s\n", this.journal.path, this.run))
+	}
 	f.WriteString("\n")
 	return nil
 }
@@ -196,22 +835,16 @@ func (this *Backup) Cleanup() error {
 	for _, table := range this.conf.ClickHouse.Tables {
 		// 备份失败，不删除数据
 		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
-		if this.states[statekey].extval == constant.BACKUP_FAILURE {
+		if this.states[statekey].extval != constant.BACKUP_SUCCESS {
 			log.Logger.Warnf("table %s backup failed, do not clean data", statekey)
 			continue
 		}
-		var err error
-		var partitions []string
-		if this.cponly {
-			partitions = strings.Split(this.partition, ",")
-		} else {
-			partitions, err = ch.Partitions(this.conf.ClickHouse.Database, table, this.partition, this.cponly)
-			if err != nil {
-				return err
-			}
+		partitions, err := this.partitions(table)
+		if err != nil {
+			return err
 		}
 		for _, p := range partitions {
-			err = ch.Clean(this.conf.ClickHouse.Database, table, p)
+			err = ch.Clean(this.ctx, this.conf.ClickHouse.Database, table, p, nil)
 			if err != nil {
 				return err
 			}
@@ -220,6 +853,110 @@ func (this *Backup) Cleanup() error {
 	return nil
 }
 
+// 所有分片都备份成功后写入manifest，shards为每个分片校验成功时记录的manifest
+func (this *Backup) writeManifest(table, partition, run string, bases []*ch.Manifest, shards []ch.ShardManifest) error {
+	m := ch.NewManifest(this.conf.ClickHouse.Database, table, partition, run, bases, shards, this.conf.S3Disk)
+	m.Version = Version
+	m.Githash = Githash
+	return ch.WriteManifest(this.ctx, m, this.conf.S3Disk)
+}
+
+// 需要处理的分区，指定分区时直接使用，否则从clickhouse中查出小于等于partition的所有分区
+func (this *Backup) partitions(table string) ([]string, error) {
+	if this.cponly {
+		return strings.Split(this.partition, ","), nil
+	}
+	return ch.Partitions(this.ctx, this.conf.ClickHouse.Database, table, this.partition, this.cponly)
+}
+
+// S3上已经备份的分区，指定分区时直接使用，否则从S3中查出[since, partition]范围内的所有分区
+func (this *Backup) remotePartitions(table string) ([]string, error) {
+	if this.cponly {
+		return strings.Split(this.partition, ","), nil
+	}
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return nil, err
+	}
+	var partitions []string
+	for p := range groupByPartition(catalog, this.conf.ClickHouse.Database, table) {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+	return partitions, nil
+}
+
+// 需要恢复的分区，未指定分区时只恢复在每个分片上都备份完整的分区，不完整的分区通过incomplete返回
+func (this *Backup) restorePartitions(table string) (partitions, incomplete []string, err error) {
+	if this.cponly {
+		return strings.Split(this.partition, ","), nil, nil
+	}
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p, entries := range groupByPartition(catalog, this.conf.ClickHouse.Database, table) {
+		if _, ok := this.pickSnapshot(entries); ok {
+			partitions = append(partitions, p)
+		} else {
+			incomplete = append(incomplete, p)
+		}
+	}
+	sort.Strings(partitions)
+	sort.Strings(incomplete)
+	return partitions, incomplete, nil
+}
+
+// S3上指定分区或[since, partition]范围内的备份，只遍历一次bucket
+func (this *Backup) remoteCatalog() ([]CatalogEntry, error) {
+	if this.catalog != nil {
+		return this.catalog, nil
+	}
+	filter := CatalogFilter{
+		Database: this.conf.ClickHouse.Database,
+	}
+	if this.cponly {
+		filter.Partitions = strings.Split(this.partition, ",")
+	} else {
+		filter.From = this.since
+		filter.To = this.partition
+	}
+	catalog, err := Catalog(this.ctx, this.conf.S3Disk.Bucket, filter)
+	if err != nil {
+		return nil, err
+	}
+	// 早期版本的备份按照host保存，需要找到host对应的分片
+	for i := range catalog {
+		if catalog[i].Shard == 0 {
+			catalog[i].Shard = this.conf.ClickHouse.ShardOf(catalog[i].Host)
+		}
+	}
+	this.catalog = catalog
+	return catalog, nil
+}
+
+// 收到信号之后的失败都是取消导致的，标记为取消
+func (this *Backup) failure(statekey string, err error) {
+	if this.ctx.Err() != nil {
+		this.states[statekey].Cancel(err)
+		return
+	}
+	this.states[statekey].Failure(err)
+}
+
+// 收到信号之后不再开始新的表或分区，并将该表标记为取消
+func (this *Backup) cancelled(statekey string) bool {
+	err := this.ctx.Err()
+	if err == nil {
+		return false
+	}
+	if _, ok := this.states[statekey]; !ok {
+		this.states[statekey] = NewState(0, 0, 0, 0)
+	}
+	this.states[statekey].Cancel(err)
+	return true
+}
+
 func (this *Backup) Stop() {
 	ch.Close()
 }
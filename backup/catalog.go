@@ -0,0 +1,259 @@
+package backup
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/layout"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bndr/gotabulate"
+)
+
+// S3上一个分片的一次备份，路径由配置的路径模板决定，默认为 partition/database.table/[run/]host
+type CatalogEntry struct {
+	Partition    string    `json:"partition"`
+	Database     string    `json:"database"`
+	Table        string    `json:"table"`
+	Run          string    `json:"run"` //为空表示早期版本的路径
+	Host         string    `json:"host,omitempty"`
+	Shard        int       `json:"shard,omitempty"` //路径模板中使用{shard}时的分片编号，从1开始
+	Objects      int       `json:"objects"`
+	Size         uint64    `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Complete     bool      `json:"complete"` //clickhouse在BACKUP成功后才会写.backup文件
+}
+
+func (e CatalogEntry) Key() string {
+	return layout.Key(layout.Vars{
+		Database:  e.Database,
+		Table:     e.Table,
+		Partition: e.Partition,
+		Run:       e.Run,
+		Host:      e.Host,
+		Shard:     e.Shard,
+	})
+}
+
+// 分片的展示名称，路径模板中没有{host}时使用分片编号
+func (e CatalogEntry) shardName() string {
+	if e.Host != "" {
+		return e.Host
+	}
+	return fmt.Sprintf("shard%d", e.Shard)
+}
+
+type CatalogFilter struct {
+	Database   string
+	Table      string
+	Partitions []string //指定分区，为空表示不限制
+	From       string   //分区下限，包含
+	To         string   //分区上限，包含
+}
+
+func (f CatalogFilter) match(partition, database, table string) bool {
+	if f.Database != "" && f.Database != database {
+		return false
+	}
+	if f.Table != "" && f.Table != table {
+		return false
+	}
+	if len(f.Partitions) > 0 {
+		found := false
+		for _, p := range f.Partitions {
+			if p == partition {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.From != "" && partition < f.From {
+		return false
+	}
+	if f.To != "" && partition > f.To {
+		return false
+	}
+	return true
+}
+
+// 遍历bucket，按照分区，表，主机汇总S3上的备份
+func Catalog(ctx context.Context, bucket string, filter CatalogFilter) ([]CatalogEntry, error) {
+	entries := make(map[string]*CatalogEntry)
+	walk := func(object *s3.Object) error {
+		v, file, ok := layout.Parse(*object.Key)
+		if !ok || !filter.match(v.Partition, v.Database, v.Table) {
+			return nil
+		}
+		entry := &CatalogEntry{
+			Partition: v.Partition,
+			Database:  v.Database,
+			Table:     v.Table,
+			Run:       v.Run,
+			Host:      v.Host,
+			Shard:     v.Shard,
+		}
+		id := entry.Key()
+		if e, ok := entries[id]; ok {
+			entry = e
+		} else {
+			entries[id] = entry
+		}
+		if file == ".backup" {
+			entry.Complete = true
+		}
+		entry.Objects++
+		entry.Size += uint64(*object.Size)
+		if object.LastModified.After(entry.LastModified) {
+			entry.LastModified = *object.LastModified
+		}
+		return nil
+	}
+
+	// 只遍历路径模板中已知的库，表，分区对应的前缀，否则遍历整个bucket
+	v := layout.Vars{Database: filter.Database, Table: filter.Table}
+	prefixes := []string{layout.Prefix(v)}
+	if len(filter.Partitions) > 0 {
+		prefixes = prefixes[:0]
+		for _, p := range filter.Partitions {
+			v.Partition = p
+			prefixes = append(prefixes, layout.Prefix(v))
+		}
+	}
+	for _, prefix := range prefixes {
+		log.Logger.Debugf("walk bucket %s, prefix: %s", bucket, prefix)
+		if err := s3client.Walk(ctx, bucket, prefix, walk); err != nil {
+			return nil, err
+		}
+	}
+
+	var catalog []CatalogEntry
+	for _, entry := range entries {
+		catalog = append(catalog, *entry)
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		if catalog[i].Partition != catalog[j].Partition {
+			return catalog[i].Partition < catalog[j].Partition
+		}
+		if catalog[i].Database != catalog[j].Database {
+			return catalog[i].Database < catalog[j].Database
+		}
+		if catalog[i].Table != catalog[j].Table {
+			return catalog[i].Table < catalog[j].Table
+		}
+		if catalog[i].Run != catalog[j].Run {
+			return catalog[i].Run < catalog[j].Run
+		}
+		if catalog[i].Shard != catalog[j].Shard {
+			return catalog[i].Shard < catalog[j].Shard
+		}
+		return catalog[i].Host < catalog[j].Host
+	})
+	return catalog, nil
+}
+
+// 按照指定格式输出备份目录，支持table, json, csv
+func WriteCatalog(w io.Writer, catalog []CatalogEntry, format string) error {
+	switch format {
+	case "json":
+		raw, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(raw))
+		return err
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"partition", "database", "table", "run", "host", "objects", "size", "last_modified", "complete"})
+		for _, e := range catalog {
+			cw.Write([]string{e.Partition, e.Database, e.Table, e.Run, e.shardName(), fmt.Sprint(e.Objects), fmt.Sprint(e.Size), e.LastModified.Format(time.RFC3339), fmt.Sprint(e.Complete)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table", "":
+		if len(catalog) == 0 {
+			_, err := fmt.Fprintln(w, "no backup found")
+			return err
+		}
+		var data [][]interface{}
+		var objects int
+		var size uint64
+		partitions := make(map[string]struct{})
+		data = append(data, []interface{}{"partition", "table", "run", "host", "objects", "size", "last_modified", "complete"})
+		for _, e := range catalog {
+			data = append(data, []interface{}{e.Partition, e.Database + "." + e.Table, e.Run, e.shardName(), e.Objects, formatReadableSize(e.Size), e.LastModified.Format("2006-01-02 15:04:05"), e.Complete})
+			objects += e.Objects
+			size += e.Size
+			partitions[e.Partition] = struct{}{}
+		}
+		tabulate := gotabulate.Create(data)
+		fmt.Fprint(w, tabulate.Render("grid"))
+		_, err := fmt.Fprintf(w, "\nTotal Partitions: %d,  Total Objects: %d,  Total Bytes: %s\n", len(partitions), objects, formatReadableSize(size))
+		return err
+	default:
+		return fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+// 按分区汇总某张表的备份
+func groupByPartition(catalog []CatalogEntry, database, table string) map[string][]CatalogEntry {
+	partitions := make(map[string][]CatalogEntry)
+	for _, e := range catalog {
+		if e.Database == database && e.Table == table {
+			partitions[e.Partition] = append(partitions[e.Partition], e)
+		}
+	}
+	return partitions
+}
+
+// 每个分片都有完整的备份，才认为该分区备份完整，entries中的Shard需要提前解析好
+// shards为0表示不限定分片数，如重新分片恢复，要求entries中的每个分片都备份完整
+func completeOnAllShards(entries []CatalogEntry, shards int) bool {
+	if shards <= 0 {
+		for _, e := range entries {
+			if !e.Complete {
+				return false
+			}
+		}
+		return len(entries) > 0
+	}
+	nums := make(map[int]struct{})
+	for _, e := range entries {
+		if e.Complete {
+			nums[e.Shard] = struct{}{}
+		}
+	}
+	for i := 1; i <= shards; i++ {
+		if _, ok := nums[i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// 最新的一次在每个分片上都备份完整的run，早期版本的备份run为空
+func latestSnapshot(entries []CatalogEntry, shards int) (string, bool) {
+	runs := make(map[string][]CatalogEntry)
+	for _, e := range entries {
+		runs[e.Run] = append(runs[e.Run], e)
+	}
+	var keys []string
+	for run := range runs {
+		keys = append(keys, run)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, run := range keys {
+		if completeOnAllShards(runs[run], shards) {
+			return run, true
+		}
+	}
+	return "", false
+}
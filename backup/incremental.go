@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/log"
+)
+
+// 该分区最新的一次成功备份以及它依赖的所有base，没有manifest时返回nil
+func (this *Backup) latestChain(table, partition string) ([]*ch.Manifest, error) {
+	m, err := ch.LatestManifest(this.ctx, this.conf.ClickHouse.Database, table, partition, this.conf.S3Disk)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return ch.ManifestChain(this.ctx, m, this.conf.S3Disk)
+}
+
+// 需要使用的run，指定了snapshot时只使用该run，否则取最新的一次在每个分片上都备份完整的run
+func (this *Backup) pickSnapshot(entries []CatalogEntry) (string, bool) {
+	shards := len(this.conf.ClickHouse.Hosts)
+	if this.reshard != nil {
+		// 重新分片恢复时备份的分片数与当前集群无关
+		shards = 0
+	}
+	if this.snapshot == "" {
+		return latestSnapshot(entries, shards)
+	}
+	var selected []CatalogEntry
+	for _, e := range entries {
+		if e.Run == this.snapshot {
+			selected = append(selected, e)
+		}
+	}
+	return this.snapshot, len(selected) > 0 && completeOnAllShards(selected, shards)
+}
+
+// 需要恢复的备份链，早期版本的备份没有manifest，返回nil，按照当前的host恢复
+func (this *Backup) restoreChain(table, partition string) ([]*ch.Manifest, error) {
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return nil, err
+	}
+	entries := groupByPartition(catalog, this.conf.ClickHouse.Database, table)[partition]
+	run, ok := this.pickSnapshot(entries)
+	if !ok && (!this.cponly || this.snapshot != "") {
+		return nil, fmt.Errorf("partition %s run %s is not backup completely on every shard", partition, run)
+	}
+	m, err := ch.SnapshotManifest(this.ctx, this.conf.ClickHouse.Database, table, partition, run, this.conf.S3Disk)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		if run != "" {
+			return nil, fmt.Errorf("manifest of partition %s run %s not found", partition, run)
+		}
+		return nil, nil
+	}
+	chain, err := ch.ManifestChain(this.ctx, m, this.conf.S3Disk)
+	if err != nil {
+		return nil, err
+	}
+	log.Logger.Infof("table %s.%s partition %s restore from %s, chain length: %d",
+		this.conf.ClickHouse.Database, table, partition, m.Key(), len(chain))
+	return chain, nil
+}
+
+// 每个分片需要恢复的备份链，下标为当前集群的分片，为nil表示该分片在备份时还不存在
+// 有manifest时按照manifest中记录的分片恢复，早期版本没有manifest的备份按照host到分片的映射查找
+func (this *Backup) restoreKeys(table, partition string, chain []*ch.Manifest) ([][]string, error) {
+	shards := len(this.conf.ClickHouse.Hosts)
+	keys := make([][]string, shards)
+	if len(chain) > 0 {
+		if len(chain[0].Shards) > shards {
+			return nil, fmt.Errorf("partition %s was backup from %d shards, but cluster has only %d shards, use --reshard to restore it", partition, len(chain[0].Shards), shards)
+		}
+		for i := range keys {
+			for _, m := range chain {
+				if i >= len(m.Shards) {
+					break
+				}
+				keys[i] = append(keys[i], m.Shards[i].Key)
+			}
+			if len(keys[i]) == 0 {
+				log.Logger.Warnf("table %s.%s partition %s shard %d has no backup, it may be added after backup",
+					this.conf.ClickHouse.Database, table, partition, i+1)
+			} else if len(keys[i]) != len(chain) {
+				return nil, fmt.Errorf("partition %s shard %d not found in every backup of the chain", partition, i+1)
+			}
+		}
+		return keys, nil
+	}
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range groupByPartition(catalog, this.conf.ClickHouse.Database, table)[partition] {
+		if e.Run == "" && e.Complete && e.Shard > 0 && e.Shard <= shards && keys[e.Shard-1] == nil {
+			keys[e.Shard-1] = []string{e.Key()}
+		}
+	}
+	for i := range keys {
+		if keys[i] == nil {
+			return nil, fmt.Errorf("partition %s shard %d has no complete backup, configure host_shards if the host has changed", partition, i+1)
+		}
+	}
+	return keys, nil
+}
+
+// 即将删除的备份中，仍被保留的增量备份作为base的分区，value为依赖它的备份
+// 指定了snapshot时只删除各分区中的该run，同一个分区中的其他run也可能依赖它
+func (this *Backup) basesInUse(table string, partitions []string) (map[string]string, error) {
+	deleting := make(map[string]struct{})
+	for _, p := range partitions {
+		deleting[p] = struct{}{}
+	}
+	deleted := func(m *ch.Manifest) bool {
+		_, ok := deleting[m.Partition]
+		return ok && (this.snapshot == "" || m.Run == this.snapshot)
+	}
+	remote, err := this.remotePartitions(table)
+	if err != nil {
+		return nil, err
+	}
+	var chains [][]*ch.Manifest
+	for _, p := range remote {
+		if _, ok := deleting[p]; ok && this.snapshot == "" {
+			continue
+		}
+		manifests, err := ch.Manifests(this.ctx, this.conf.ClickHouse.Database, table, p, this.conf.S3Disk)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range manifests {
+			if deleted(m) {
+				continue
+			}
+			chain, err := ch.ManifestChain(this.ctx, m, this.conf.S3Disk)
+			if err != nil {
+				log.Logger.Warnf("table %s.%s %v", this.conf.ClickHouse.Database, table, err)
+				continue
+			}
+			chains = append(chains, chain)
+		}
+	}
+	return basesNeeded(chains, deleted), nil
+}
+
+// 保留的备份链中被删除的base，key为base所在的分区，value为依赖它的备份
+func basesNeeded(chains [][]*ch.Manifest, deleted func(m *ch.Manifest) bool) map[string]string {
+	inUse := make(map[string]string)
+	for _, chain := range chains {
+		if len(chain) == 0 || deleted(chain[0]) {
+			continue
+		}
+		for _, base := range chain[1:] {
+			if deleted(base) {
+				inUse[base.Partition] = chain[0].Key()
+			}
+		}
+	}
+	return inUse
+}
@@ -0,0 +1,29 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasesNeeded(t *testing.T) {
+	full := &ch.Manifest{Database: "default", Table: "t", Partition: "20230701"}
+	incr := &ch.Manifest{Database: "default", Table: "t", Partition: "20230702", Run: "20230702T010000", Base: full.Key()}
+	other := &ch.Manifest{Database: "default", Table: "t", Partition: "20230703"}
+	chains := [][]*ch.Manifest{{incr, full}, {other}}
+
+	deleted := func(partitions ...string) func(m *ch.Manifest) bool {
+		return func(m *ch.Manifest) bool {
+			for _, p := range partitions {
+				if m.Partition == p {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	assert.Equal(t, map[string]string{"20230701": incr.Key()}, basesNeeded(chains, deleted("20230701")))
+	assert.Empty(t, basesNeeded(chains, deleted("20230701", "20230702")))
+	assert.Empty(t, basesNeeded(chains, deleted("20230703")))
+}
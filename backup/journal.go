@@ -0,0 +1,377 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/constant"
+	"github.com/YenchangChan/ch2s3/log"
+)
+
+// 表分区在journal中的状态
+const (
+	UNIT_PENDING   = "PENDING"
+	UNIT_RUNNING   = "RUNNING"
+	UNIT_BACKED_UP = "BACKED_UP" //已经写入manifest，还没有清理本地数据
+	UNIT_DONE      = "DONE"
+	UNIT_FAILED    = "FAILED"
+	UNIT_CANCELLED = "CANCELLED"
+)
+
+// 一次运行的journal，保存在cwd/journal/<op>_<run>.json，每次状态变化都会重写该文件
+// 运行中断后通过--resume <run>继续，跳过已经完成的表分区
+type Journal struct {
+	lock      sync.Mutex
+	path      string
+	Run       string                   `json:"run"`
+	Op        string                   `json:"op"`
+	Partition string                   `json:"partition"`
+	Since     string                   `json:"since,omitempty"`
+	Cponly    bool                     `json:"cponly"`
+	Attempt   int                      `json:"attempt"` //第几次执行，从1开始
+	Tables    map[string]*TableJournal `json:"tables"`
+}
+
+type TableJournal struct {
+	Rows             uint64                  `json:"rows"`
+	UncompressedSize uint64                  `json:"uncompressed_size"`
+	CompressedSize   uint64                  `json:"compressed_size"`
+	Elapsed          int                     `json:"elapsed"` //所有尝试累计的耗时
+	Status           string                  `json:"status,omitempty"`
+	Error            string                  `json:"error,omitempty"`
+	Partitions       map[string]*UnitJournal `json:"partitions"`
+}
+
+type UnitJournal struct {
+	Size       uint64         `json:"size"` //压缩后的大小，用于调度
+	State      string         `json:"state"`
+	Attempt    int            `json:"attempt"` //进入当前状态时是第几次执行
+	Error      string         `json:"error,omitempty"`
+	RemoteSize uint64         `json:"remote_size"`
+	Shards     []ShardJournal `json:"shards,omitempty"`
+	History    []Transition   `json:"history"`
+}
+
+type ShardJournal struct {
+	Shard    int               `json:"shard"` //从1开始
+	Host     string            `json:"host"`
+	Key      string            `json:"key,omitempty"`
+	State    string            `json:"state"` //DONE或者FAILED
+	Error    string            `json:"error,omitempty"`
+	Cleaned  bool              `json:"cleaned"`            //已经清理本地数据
+	Manifest *ch.ShardManifest `json:"manifest,omitempty"` //校验成功后记录，清理本地数据之后仍然可以生成分区的manifest
+}
+
+type Transition struct {
+	State   string    `json:"state"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func journalPath(cwd, op_type, run string) string {
+	return path.Join(cwd, "journal", fmt.Sprintf("%s_%s.json", op_type, run))
+}
+
+func newJournal(cwd, op_type, run string) *Journal {
+	return &Journal{
+		path:    journalPath(cwd, op_type, run),
+		Run:     run,
+		Op:      op_type,
+		Attempt: 1,
+		Tables:  make(map[string]*TableJournal),
+	}
+}
+
+// 加载之前的journal继续执行，attempt加1
+func loadJournal(cwd, op_type, run string) (*Journal, error) {
+	j, err := readJournal(journalPath(cwd, op_type, run))
+	if err != nil {
+		return nil, fmt.Errorf("load journal of run %s failed: %v", run, err)
+	}
+	j.Attempt++
+	return j, nil
+}
+
+func readJournal(file string) (*Journal, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	if err = json.Unmarshal(raw, j); err != nil {
+		return nil, fmt.Errorf("parse journal %s failed: %v", file, err)
+	}
+	if j.Tables == nil {
+		j.Tables = make(map[string]*TableJournal)
+	}
+	j.path = file
+	return j, nil
+}
+
+// 其他run中已经删除了部分分片的本地数据、但还没有写入manifest的表分区，key为statekey/partition，value为run
+// 这些分片的数据只存在于该run中，只能通过--resume继续完成
+func unfinishedCleans(cwd, op_type, run string) (map[string]string, error) {
+	files, err := filepath.Glob(journalPath(cwd, op_type, "*"))
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[string]string)
+	for _, file := range files {
+		j, err := readJournal(file)
+		if err != nil {
+			return nil, err
+		}
+		if j.Run == run {
+			continue
+		}
+		for statekey, t := range j.Tables {
+			for p, u := range t.Partitions {
+				if u.State == UNIT_DONE || u.State == UNIT_BACKED_UP {
+					continue
+				}
+				for _, shard := range u.Shards {
+					if shard.Cleaned {
+						pinned[fmt.Sprintf("%s/%s", statekey, p)] = j.Run
+						break
+					}
+				}
+			}
+		}
+	}
+	return pinned, nil
+}
+
+// 调用时需要持有锁，写入失败只打印日志，不影响备份
+func (j *Journal) save() {
+	raw, err := json.MarshalIndent(j, "", "  ")
+	if err == nil {
+		os.MkdirAll(path.Dir(j.path), 0755)
+		tmp := j.path + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0644); err == nil {
+			err = os.Rename(tmp, j.path)
+		}
+	}
+	if err != nil {
+		log.Logger.Errorf("write journal %s failed: %v", j.path, err)
+	}
+}
+
+// 之前的尝试中已经统计过的表，没有时返回nil
+func (j *Journal) table(statekey string) *TableJournal {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.Tables[statekey]
+}
+
+// 记录一张表需要备份的分区
+func (j *Journal) addTable(statekey string, rows, buncsize, bcsize uint64, units []*unit) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	t := &TableJournal{
+		Rows:             rows,
+		UncompressedSize: buncsize,
+		CompressedSize:   bcsize,
+		Partitions:       make(map[string]*UnitJournal),
+	}
+	for _, u := range units {
+		t.Partitions[u.partition] = &UnitJournal{
+			Size:    u.size,
+			State:   UNIT_PENDING,
+			Attempt: j.Attempt,
+			History: []Transition{{State: UNIT_PENDING, Attempt: j.Attempt, Time: time.Now()}},
+		}
+	}
+	j.Tables[statekey] = t
+	j.save()
+}
+
+func (j *Journal) state(statekey, partition string) string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if u := j.unit(statekey, partition); u != nil {
+		return u.State
+	}
+	return ""
+}
+
+// 之前的尝试中写入manifest时S3上的大小
+func (j *Journal) remoteSize(statekey, partition string) uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if u := j.unit(statekey, partition); u != nil {
+		return u.RemoteSize
+	}
+	return 0
+}
+
+func (j *Journal) unit(statekey, partition string) *UnitJournal {
+	if t, ok := j.Tables[statekey]; ok {
+		return t.Partitions[partition]
+	}
+	return nil
+}
+
+// 记录表分区的状态变化
+func (j *Journal) transit(statekey, partition, state string, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.transitLocked(statekey, partition, state, err)
+}
+
+func (j *Journal) transitLocked(statekey, partition, state string, err error) {
+	u := j.unit(statekey, partition)
+	if u == nil {
+		return
+	}
+	u.State = state
+	u.Attempt = j.Attempt
+	u.Error = ""
+	if err != nil {
+		u.Error = err.Error()
+	}
+	u.History = append(u.History, Transition{State: state, Attempt: j.Attempt, Time: time.Now(), Error: u.Error})
+	j.save()
+}
+
+// 所有分片都备份成功并写入manifest
+func (j *Journal) backedUp(statekey, partition string, rsize uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if u := j.unit(statekey, partition); u != nil {
+		u.RemoteSize = rsize
+	}
+	j.transitLocked(statekey, partition, UNIT_BACKED_UP, nil)
+}
+
+// 记录一个分片的备份结果，之前的结果被覆盖
+func (j *Journal) shardResult(statekey, partition string, r ch.ShardResult) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	u := j.unit(statekey, partition)
+	if u == nil {
+		return
+	}
+	shard := ShardJournal{Shard: r.Shard + 1, Host: r.Host, Key: r.Key, State: UNIT_DONE, Manifest: r.Manifest}
+	if r.Err != nil {
+		shard.State = UNIT_FAILED
+		shard.Error = r.Err.Error()
+	}
+	for i := range u.Shards {
+		if u.Shards[i].Shard == shard.Shard {
+			u.Shards[i] = shard
+			j.save()
+			return
+		}
+	}
+	u.Shards = append(u.Shards, shard)
+	sort.Slice(u.Shards, func(a, b int) bool { return u.Shards[a].Shard < u.Shards[b].Shard })
+	j.save()
+}
+
+// 已经备份并校验成功的分片的manifest
+func (j *Journal) verifiedShards(statekey, partition string) []ch.ShardManifest {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var shards []ch.ShardManifest
+	if u := j.unit(statekey, partition); u != nil {
+		for _, shard := range u.Shards {
+			if shard.State == UNIT_DONE && shard.Manifest != nil {
+				shards = append(shards, *shard.Manifest)
+			}
+		}
+	}
+	return shards
+}
+
+// 已经清理本地数据的分片，从0开始
+func (j *Journal) cleanedShards(statekey, partition string) map[int]bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	cleaned := make(map[int]bool)
+	if u := j.unit(statekey, partition); u != nil {
+		for _, shard := range u.Shards {
+			if shard.Cleaned {
+				cleaned[shard.Shard-1] = true
+			}
+		}
+	}
+	return cleaned
+}
+
+// 记录已经清理本地数据的分片，从0开始
+func (j *Journal) cleaned(statekey, partition string, shards []int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	u := j.unit(statekey, partition)
+	if u == nil {
+		return
+	}
+	for i := range u.Shards {
+		for _, shard := range shards {
+			if u.Shards[i].Shard == shard+1 {
+				u.Shards[i].Cleaned = true
+			}
+		}
+	}
+	j.save()
+}
+
+// 记录表的最终结果
+func (j *Journal) finish(statekey string, s *State) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	t, ok := j.Tables[statekey]
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	t.Elapsed = s.elasped
+	t.Status = status(s.extval)
+	t.Error = ""
+	if s.extval != constant.BACKUP_SUCCESS && s.why != nil {
+		t.Error = s.why.Error()
+	}
+	s.lock.Unlock()
+	j.save()
+}
+
+// 所有表都成功并且所有表分区都已经完成时删除journal，该run不需要再--resume，之后的运行也不会再读取它
+func (j *Journal) removeIfDone() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, t := range j.Tables {
+		if t.Status != status(constant.BACKUP_SUCCESS) {
+			return
+		}
+		for _, u := range t.Partitions {
+			if u.State != UNIT_DONE {
+				return
+			}
+		}
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		log.Logger.Errorf("remove journal %s failed: %v", j.path, err)
+		return
+	}
+	log.Logger.Infof("all partitions of run %s are done, journal %s removed", j.Run, j.path)
+}
+
+// 之前的尝试中已经完成的分区
+func (t *TableJournal) done() []string {
+	var partitions []string
+	for p, u := range t.Partitions {
+		if u.State == UNIT_DONE {
+			partitions = append(partitions, p)
+		}
+	}
+	sort.Strings(partitions)
+	return partitions
+}
@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/constant"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	cwd := t.TempDir()
+	j := newJournal(cwd, "backup", "20230801T020000")
+	j.Partition = "20230731"
+	units := []*unit{
+		{table: "events", partition: "20230730", size: 10},
+		{table: "events", partition: "20230731", size: 20},
+		{table: "events", partition: "20230801", size: 30},
+	}
+	j.addTable("default.events", 100, 2000, 1000, units)
+	j.transit("default.events", "20230730", UNIT_RUNNING, nil)
+	j.shardResult("default.events", "20230730", ch.ShardResult{Shard: 0, Host: "h1", Key: "k1", Manifest: &ch.ShardManifest{Shard: 0, Host: "h1", Key: "k1", Rows: 50}})
+	j.backedUp("default.events", "20230730", 900)
+	j.transit("default.events", "20230730", UNIT_DONE, nil)
+	j.transit("default.events", "20230731", UNIT_RUNNING, nil)
+	j.backedUp("default.events", "20230731", 800)
+	// 分片2先失败，分片1成功并清理了本地数据
+	j.shardResult("default.events", "20230801", ch.ShardResult{Shard: 1, Host: "h2", Err: errors.New("timeout")})
+	j.shardResult("default.events", "20230801", ch.ShardResult{Shard: 0, Host: "h1", Key: "k1", Manifest: &ch.ShardManifest{Shard: 0, Host: "h1", Key: "k1", Rows: 30}})
+	j.cleaned("default.events", "20230801", []int{0})
+	j.transit("default.events", "20230801", UNIT_FAILED, errors.New("backup failed"))
+	// 不存在的分区不记录
+	j.transit("default.events", "20230802", UNIT_DONE, nil)
+
+	r, err := loadJournal(cwd, "backup", "20230801T020000")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, r.Attempt)
+	assert.Equal(t, "20230731", r.Partition)
+	table := r.table("default.events")
+	assert.NotNil(t, table)
+	assert.Equal(t, uint64(100), table.Rows)
+	assert.Equal(t, 3, len(table.Partitions))
+	assert.Equal(t, []string{"20230730"}, table.done())
+	assert.Equal(t, UNIT_BACKED_UP, r.state("default.events", "20230731"))
+	assert.Equal(t, uint64(800), r.remoteSize("default.events", "20230731"))
+	assert.Equal(t, []ch.ShardManifest{{Shard: 0, Host: "h1", Key: "k1", Rows: 50}}, r.verifiedShards("default.events", "20230730"))
+
+	u := table.Partitions["20230801"]
+	assert.Equal(t, UNIT_FAILED, u.State)
+	assert.Equal(t, "backup failed", u.Error)
+	assert.Equal(t, []string{UNIT_PENDING, UNIT_FAILED}, []string{u.History[0].State, u.History[1].State})
+	assert.Equal(t, 2, len(u.Shards))
+	assert.Equal(t, ShardJournal{Shard: 2, Host: "h2", State: UNIT_FAILED, Error: "timeout"}, u.Shards[1])
+	assert.Equal(t, []ch.ShardManifest{{Shard: 0, Host: "h1", Key: "k1", Rows: 30}}, r.verifiedShards("default.events", "20230801"))
+	assert.Equal(t, map[int]bool{0: true}, r.cleanedShards("default.events", "20230801"))
+
+	// 重试成功后覆盖之前的结果
+	r.shardResult("default.events", "20230801", ch.ShardResult{Shard: 1, Host: "h2", Key: "k2", Manifest: &ch.ShardManifest{Shard: 1, Host: "h2", Key: "k2", Rows: 20}})
+	assert.Equal(t, 2, len(r.verifiedShards("default.events", "20230801")))
+
+	_, err = loadJournal(cwd, "backup", "20230802T020000")
+	assert.NotNil(t, err)
+}
+
+func TestUnfinishedCleans(t *testing.T) {
+	cwd := t.TempDir()
+	units := []*unit{{table: "events", partition: "20230730"}, {table: "events", partition: "20230731"}}
+	j := newJournal(cwd, "backup", "20230801T020000")
+	j.addTable("default.events", 100, 2000, 1000, units)
+	for _, p := range []string{"20230730", "20230731"} {
+		j.shardResult("default.events", p, ch.ShardResult{Shard: 0, Host: "h1", Key: "k1", Manifest: &ch.ShardManifest{Shard: 0}})
+		j.shardResult("default.events", p, ch.ShardResult{Shard: 1, Host: "h2", Err: errors.New("timeout")})
+		j.cleaned("default.events", p, []int{0})
+	}
+	j.transit("default.events", "20230730", UNIT_FAILED, errors.New("1 of 2 shards failed"))
+	// 继续之后已经写入manifest的分区不再受限
+	j.backedUp("default.events", "20230731", 100)
+
+	pinned, err := unfinishedCleans(cwd, "backup", "20230802T020000")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"default.events/20230730": "20230801T020000"}, pinned)
+
+	// 继续该run本身时不受限
+	pinned, err = unfinishedCleans(cwd, "backup", "20230801T020000")
+	assert.Nil(t, err)
+	assert.Empty(t, pinned)
+}
+
+func TestRemoveIfDone(t *testing.T) {
+	log.InitLogger("error", []string{"stderr"})
+	cwd := t.TempDir()
+	units := []*unit{{table: "events", partition: "20230730"}, {table: "events", partition: "20230731"}}
+	j := newJournal(cwd, "backup", "20230801T020000")
+	j.addTable("default.events", 100, 2000, 1000, units)
+	j.transit("default.events", "20230730", UNIT_DONE, nil)
+	j.transit("default.events", "20230731", UNIT_FAILED, errors.New("timeout"))
+	j.finish("default.events", &State{extval: constant.BACKUP_FAILURE})
+	j.removeIfDone()
+	_, err := os.Stat(j.path)
+	assert.Nil(t, err)
+
+	// 继续之后全部完成
+	j.transit("default.events", "20230731", UNIT_DONE, nil)
+	j.finish("default.events", &State{extval: constant.BACKUP_SUCCESS})
+	j.removeIfDone()
+	_, err = os.Stat(j.path)
+	assert.True(t, os.IsNotExist(err))
+	pinned, err := unfinishedCleans(cwd, "backup", "20230802T020000")
+	assert.Nil(t, err)
+	assert.Empty(t, pinned)
+}
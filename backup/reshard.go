@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/log"
+)
+
+// 设置重新分片恢复，备份时的分片数与当前集群不一致时使用
+func (this *Backup) SetReshard(reshard *ch.Reshard) {
+	this.reshard = reshard
+}
+
+// 每个源分片需要恢复的备份链，与当前集群的分片数无关，hosts为备份时使用的host
+func (this *Backup) sourceKeys(table, partition string, chain []*ch.Manifest) ([][]string, []string, error) {
+	var keys [][]string
+	var hosts []string
+	if len(chain) > 0 {
+		for i, shard := range chain[0].Shards {
+			var shardKeys []string
+			for _, m := range chain {
+				if i >= len(m.Shards) {
+					return nil, nil, fmt.Errorf("partition %s shard %d not found in manifest %s", partition, i+1, m.Key())
+				}
+				shardKeys = append(shardKeys, m.Shards[i].Key)
+			}
+			keys = append(keys, shardKeys)
+			hosts = append(hosts, shard.Host)
+		}
+		return keys, hosts, nil
+	}
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range groupByPartition(catalog, this.conf.ClickHouse.Database, table)[partition] {
+		if e.Run == "" && e.Complete {
+			keys = append(keys, []string{e.Key()})
+			hosts = append(hosts, e.shardName())
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("partition %s has no complete backup", partition)
+	}
+	return keys, hosts, nil
+}
+
+// 重新分片恢复一个分区，每个源分片的进度记录到state中
+func (this *Backup) reshardRestore(statekey, table, tdatabase, ttable, partition string, chain []*ch.Manifest) error {
+	keys, hosts, err := this.sourceKeys(table, partition, chain)
+	if err != nil {
+		return err
+	}
+	if tdatabase != this.conf.ClickHouse.Database || ttable != table {
+		// 目标表不存在时，按照第一个源分片备份中的表结构在当前集群的每个分片上创建
+		targets := make([][]string, len(this.conf.ClickHouse.Hosts))
+		for i := range targets {
+			targets[i] = keys[0]
+		}
+		if err = ch.CreateRestoreTable(this.ctx, this.conf.ClickHouse.Database, table, tdatabase, ttable, targets, this.conf.S3Disk); err != nil {
+			return err
+		}
+	}
+	log.Logger.Infof("table %s partition %s reshard restore from %d shards to %d shards", statekey, partition, len(keys), len(this.conf.ClickHouse.Hosts))
+	return ch.ReshardRestore(this.ctx, this.conf.ClickHouse.Database, table, tdatabase, ttable, partition, this.run, keys, hosts,
+		*this.reshard, this.conf.S3Disk, func(p ch.ShardProgress) {
+			this.states[statekey].Progress(partition, p)
+		})
+}
+
+// 重新分片后每个分片的数据与备份时不同，只比对恢复后的总行数与manifest中记录的是否一致
+func (this *Backup) verifyReshard(database, table, partition string, chain []*ch.Manifest, rows uint64) error {
+	if len(chain) == 0 {
+		log.Logger.Warnf("table %s.%s partition %s has no manifest, skip verify", database, table, partition)
+		return nil
+	}
+	if rows != chain[0].Rows {
+		err := fmt.Errorf("partition %s restored rows %d mismatch with backup %d", partition, rows, chain[0].Rows)
+		log.Logger.Errorf("table %s.%s %v", database, table, err)
+		return err
+	}
+	log.Logger.Infof("table %s.%s partition %s restored data match with backup, rows: %d", database, table, partition, rows)
+	return nil
+}
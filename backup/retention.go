@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/config"
+)
+
+// 分区对应的日期，支持toYYYYMMDD, toYYYYMM, toDate格式的分区
+func partitionDate(partition string) (time.Time, bool) {
+	for _, layout := range []string{"20060102", "200601", "2006-01-02"} {
+		if len(partition) != len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, partition, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 根据保留策略计算需要删除的分区，无法解析为日期的分区永远不会被删除，通过skipped返回
+func retentionPlan(partitions []string, policy config.Policy, now time.Time) (expired, skipped []string) {
+	if policy.Empty() {
+		return nil, nil
+	}
+	type dated struct {
+		partition string
+		date      time.Time
+	}
+	var all []dated
+	for _, p := range partitions {
+		if t, ok := partitionDate(p); ok {
+			all = append(all, dated{p, t})
+		} else {
+			skipped = append(skipped, p)
+		}
+	}
+	// 从新到旧
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].date.After(all[j].date)
+	})
+
+	keep := make(map[string]struct{})
+	if policy.KeepDays > 0 {
+		since := now.AddDate(0, 0, -policy.KeepDays)
+		for _, d := range all {
+			if !d.date.Before(since) {
+				keep[d.partition] = struct{}{}
+			}
+		}
+	}
+	for i := 0; i < policy.Daily && i < len(all); i++ {
+		keep[all[i].partition] = struct{}{}
+	}
+	weeks := make(map[string]struct{})
+	months := make(map[string]struct{})
+	for _, d := range all {
+		year, week := d.date.ISOWeek()
+		wk := fmt.Sprintf("%d-%02d", year, week)
+		if _, ok := weeks[wk]; !ok && len(weeks) < policy.Weekly {
+			weeks[wk] = struct{}{}
+			keep[d.partition] = struct{}{}
+		}
+		mk := d.date.Format("200601")
+		if _, ok := months[mk]; !ok && len(months) < policy.Monthly {
+			months[mk] = struct{}{}
+			keep[d.partition] = struct{}{}
+		}
+	}
+
+	for _, d := range all {
+		if _, ok := keep[d.partition]; !ok {
+			expired = append(expired, d.partition)
+		}
+	}
+	sort.Strings(expired)
+	return expired, skipped
+}
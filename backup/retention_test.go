@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPlan(t *testing.T) {
+	now := time.Date(2023, 7, 31, 12, 0, 0, 0, time.Local)
+	var partitions []string
+	for d := time.Date(2023, 5, 1, 0, 0, 0, 0, time.Local); !d.After(now); d = d.AddDate(0, 0, 1) {
+		partitions = append(partitions, d.Format("20060102"))
+	}
+	partitions = append(partitions, "tuple()")
+
+	expired, skipped := retentionPlan(partitions, config.Policy{}, now)
+	assert.Empty(t, expired)
+	assert.Empty(t, skipped)
+
+	expired, skipped = retentionPlan(partitions, config.Policy{KeepDays: 7}, now)
+	assert.Equal(t, []string{"tuple()"}, skipped)
+	assert.Equal(t, len(partitions)-1-7, len(expired))
+	assert.Contains(t, expired, "20230724")
+	assert.NotContains(t, expired, "20230725")
+
+	expired, _ = retentionPlan(partitions, config.Policy{Daily: 3, Weekly: 2, Monthly: 3}, now)
+	kept := make(map[string]bool)
+	for _, p := range partitions {
+		kept[p] = true
+	}
+	for _, p := range expired {
+		delete(kept, p)
+	}
+	delete(kept, "tuple()")
+	// 最近3天，最近2周的最后一天，最近3个月的最后一天
+	assert.Equal(t, map[string]bool{
+		"20230731": true, "20230730": true, "20230729": true,
+		"20230630": true, "20230531": true,
+	}, kept)
+}
+
+func TestPartitionDate(t *testing.T) {
+	_, ok := partitionDate("20230731")
+	assert.True(t, ok)
+	_, ok = partitionDate("202307")
+	assert.True(t, ok)
+	_, ok = partitionDate("2023-07-31")
+	assert.True(t, ok)
+	_, ok = partitionDate("1")
+	assert.False(t, ok)
+}
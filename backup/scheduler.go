@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/YenchangChan/ch2s3/config"
+)
+
+// 调度的最小单元，一张表的一个分区
+type unit struct {
+	table     string
+	partition string
+	size      uint64   //压缩后的大小
+	hosts     []string //备份该分区时使用的clickhouse节点
+}
+
+// 按照大小从大到小排序，大小相同时按照表名和分区排序，保证每次的顺序一致
+func sortUnits(units []*unit) {
+	sort.SliceStable(units, func(i, j int) bool {
+		if units[i].size != units[j].size {
+			return units[i].size > units[j].size
+		}
+		if units[i].table != units[j].table {
+			return units[i].table < units[j].table
+		}
+		return units[i].partition < units[j].partition
+	})
+}
+
+// 按照全局、每个节点、每张表的并发限制调度表分区
+type scheduler struct {
+	limits  config.Concurrency
+	lock    sync.Mutex
+	cond    *sync.Cond
+	running int
+	tables  map[string]int
+	hosts   map[string]int
+}
+
+func newScheduler(limits config.Concurrency) *scheduler {
+	s := &scheduler{
+		limits: limits,
+		tables: make(map[string]int),
+		hosts:  make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// 调用时需要持有锁
+func (s *scheduler) runnable(u *unit) bool {
+	if s.limits.Global > 0 && s.running >= s.limits.Global {
+		return false
+	}
+	if s.limits.PerTable > 0 && s.tables[u.table] >= s.limits.PerTable {
+		return false
+	}
+	if s.limits.PerHost > 0 {
+		for _, h := range u.hosts {
+			if s.hosts[h] >= s.limits.PerHost {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *scheduler) acquire(u *unit) {
+	s.running++
+	s.tables[u.table]++
+	for _, h := range u.hosts {
+		s.hosts[h]++
+	}
+}
+
+func (s *scheduler) release(u *unit) {
+	s.lock.Lock()
+	s.running--
+	s.tables[u.table]--
+	for _, h := range u.hosts {
+		s.hosts[h]--
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// 按照units的顺序调度，排在前面的单元受限时先调度后面可以运行的单元，所有单元执行完成后返回
+// fn的第一个参数为调度的序号，从1开始；ctx取消后不再调度新的单元，等待正在执行的单元结束后返回没有调度的单元
+func (s *scheduler) run(ctx context.Context, units []*unit, fn func(seq int, u *unit)) []*unit {
+	var wg sync.WaitGroup
+	pending := append([]*unit(nil), units...)
+	seq := 0
+	stop := context.AfterFunc(ctx, func() {
+		s.lock.Lock()
+		s.cond.Broadcast()
+		s.lock.Unlock()
+	})
+	defer stop()
+	s.lock.Lock()
+	for len(pending) > 0 && ctx.Err() == nil {
+		idx := -1
+		for i, u := range pending {
+			if s.runnable(u) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			s.cond.Wait()
+			continue
+		}
+		u := pending[idx]
+		pending = append(pending[:idx], pending[idx+1:]...)
+		s.acquire(u)
+		seq++
+		wg.Add(1)
+		go func(seq int, u *unit) {
+			defer wg.Done()
+			defer s.release(u)
+			fn(seq, u)
+		}(seq, u)
+	}
+	s.lock.Unlock()
+	wg.Wait()
+	return pending
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortUnits(t *testing.T) {
+	units := []*unit{
+		{table: "t2", partition: "20230102", size: 10},
+		{table: "t1", partition: "20230102", size: 30},
+		{table: "t1", partition: "20230101", size: 10},
+		{table: "t2", partition: "20230101", size: 10},
+	}
+	sortUnits(units)
+	var order []string
+	for _, u := range units {
+		order = append(order, u.table+"/"+u.partition)
+	}
+	assert.Equal(t, []string{"t1/20230102", "t1/20230101", "t2/20230101", "t2/20230102"}, order)
+}
+
+func TestScheduler(t *testing.T) {
+	var units []*unit
+	for _, table := range []string{"t1", "t2", "t3"} {
+		for _, p := range []string{"20230101", "20230102", "20230103", "20230104"} {
+			units = append(units, &unit{table: table, partition: p, hosts: []string{"h1", "h2"}})
+		}
+	}
+	limits := config.Concurrency{Global: 3, PerHost: 2, PerTable: 1}
+	var lock sync.Mutex
+	var running, maxRunning int
+	tables := make(map[string]int)
+	done := make(map[string]bool)
+	newScheduler(limits).run(context.Background(), units, func(seq int, u *unit) {
+		lock.Lock()
+		running++
+		tables[u.table]++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		assert.LessOrEqual(t, tables[u.table], limits.PerTable)
+		lock.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		tables[u.table]--
+		done[u.table+"/"+u.partition] = true
+		lock.Unlock()
+	})
+	assert.Equal(t, len(units), len(done))
+	// 每个单元都使用h1和h2，每个节点最多2个
+	assert.Equal(t, 2, maxRunning)
+
+	// 不限制时全部同时运行
+	running, maxRunning = 0, 0
+	newScheduler(config.Concurrency{}).run(context.Background(), units, func(seq int, u *unit) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	})
+	assert.Equal(t, len(units), maxRunning)
+
+	// 取消后不再调度新的单元，返回没有调度的单元
+	ctx, cancel := context.WithCancel(context.Background())
+	var started int
+	skipped := newScheduler(config.Concurrency{Global: 2}).run(ctx, units, func(seq int, u *unit) {
+		lock.Lock()
+		started++
+		lock.Unlock()
+		cancel()
+		time.Sleep(5 * time.Millisecond)
+	})
+	assert.LessOrEqual(t, started, 2)
+	assert.Equal(t, len(units), started+len(skipped))
+}
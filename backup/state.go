@@ -1,14 +1,19 @@
 package backup
 
 import (
+	"sync"
 	"time"
 
+	"github.com/YenchangChan/ch2s3/ch"
 	"github.com/YenchangChan/ch2s3/constant"
 )
 
+// 一张表的执行结果，并发备份多个分区时通过lock保护
 type State struct {
+	lock       sync.Mutex
 	start      time.Time
 	elasped    int
+	before     int //继续中断的运行时，之前的尝试已经花费的时间
 	partitions int
 	rows       uint64
 	buncsize   uint64
@@ -16,6 +21,22 @@ type State struct {
 	rsize      uint64
 	extval     int
 	why        error
+	deleted    []string //从S3上删除的分区
+	resumed    []string //之前的尝试中已经完成的分区
+	progress   []shardProgress
+	shards     []shardResult
+}
+
+// 重新分片恢复时每个源分片的进度
+type shardProgress struct {
+	partition string
+	ch.ShardProgress
+}
+
+// 备份时每个分片的结果
+type shardResult struct {
+	partition string
+	ch.ShardResult
 }
 
 func NewState(rows, buncsize, bcsize uint64, partitions int) *State {
@@ -29,6 +50,8 @@ func NewState(rows, buncsize, bcsize uint64, partitions int) *State {
 }
 
 func (s *State) Set(key string, value any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	switch key {
 	case constant.STATE_ROWS:
 		s.rows = value.(uint64)
@@ -41,21 +64,90 @@ func (s *State) Set(key string, value any) {
 	}
 }
 
+// 累加行数和大小，用于按分区汇总
+func (s *State) Add(rows, buncsize, bcsize uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rows += rows
+	s.buncsize += buncsize
+	s.bcsize += bcsize
+}
+
+func (s *State) Deleted(partition string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deleted = append(s.deleted, partition)
+}
+
+func (s *State) Shard(partition string, r ch.ShardResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shards = append(s.shards, shardResult{partition: partition, ShardResult: r})
+}
+
+func (s *State) Progress(partition string, p ch.ShardProgress) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.progress = append(s.progress, shardProgress{partition: partition, ShardProgress: p})
+}
+
+// 继续中断的运行，合并之前的尝试中已经完成的分区
+func (s *State) Resume(elapsed int, rsize uint64, done []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.before = elapsed
+	s.rsize += rsize
+	s.resumed = done
+}
+
 func (s *State) Success() {
-	s.elasped = int(time.Since(s.start).Seconds())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.elasped = s.before + int(time.Since(s.start).Seconds())
 	s.extval = constant.BACKUP_SUCCESS
 }
 
 func (s *State) Failure(err error) {
-	s.elasped = int(time.Since(s.start).Seconds())
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.elasped = s.before + int(time.Since(s.start).Seconds())
 	s.why = err
 	s.extval = constant.BACKUP_FAILURE
 }
 
+// 被取消，之前已经失败时仍然保留失败的原因
+func (s *State) Cancel(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.elasped = s.before + int(time.Since(s.start).Seconds())
+	if s.extval == constant.BACKUP_FAILURE {
+		return
+	}
+	s.why = err
+	s.extval = constant.BACKUP_CANCELLED
+}
+
+// 失败或者被取消
+func (s *State) Failed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.extval == constant.BACKUP_FAILURE || s.extval == constant.BACKUP_CANCELLED
+}
+
 func status(s int) string {
-	if s == constant.BACKUP_SUCCESS {
+	switch s {
+	case constant.BACKUP_SUCCESS:
 		return "SUCCESS"
-	} else {
+	case constant.BACKUP_CANCELLED:
+		return "CANCELLED"
+	default:
 		return "FAILURE"
 	}
 }
+
+func result(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	return err.Error()
+}
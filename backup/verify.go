@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/constant"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+	"github.com/bndr/gotabulate"
+)
+
+// 恢复完成后，比对每个分片恢复后的行数和大小与备份时manifest中记录的是否一致
+// 增量备份的manifest中记录的是备份时整个分区的数据，与恢复整条备份链后的结果比对，恢复到其他表时比对目标表
+// 追加恢复时before为恢复前每个分片的统计信息，只比对恢复前后的差值
+func (this *Backup) verifyRestore(database, table, partition string, chain []*ch.Manifest, before []ch.ShardStat) error {
+	if len(chain) == 0 {
+		// 早期版本备份的数据没有manifest，无法比对
+		log.Logger.Warnf("table %s.%s partition %s has no manifest, skip verify", database, table, partition)
+		return nil
+	}
+	m := chain[0]
+	stats, err := ch.PartitionStats(this.ctx, database, table, partition)
+	if err != nil {
+		return err
+	}
+	if len(before) > 0 {
+		log.Logger.Infof("table %s.%s partition %s was not empty before restore, verify the appended data only", database, table, partition)
+		stats = appendedStats(stats, before)
+	}
+	diff, mismatch := shardDiff(m, stats)
+	if mismatch {
+		log.Logger.Errorf("table %s.%s partition %s restored data mismatch with backup:\n%s", database, table, partition, diff)
+		return fmt.Errorf("partition %s restored data mismatch with backup:\n%s", partition, diff)
+	}
+	log.Logger.Infof("table %s.%s partition %s restored data match with backup, rows: %d", database, table, partition, m.Rows)
+	return nil
+}
+
+// 从恢复后每个分片的统计信息中减去恢复前的，得到本次恢复追加的数据
+// 恢复期间该分区有其他写入或删除时，比对结果不一致
+func appendedStats(after, before []ch.ShardStat) []ch.ShardStat {
+	stats := make([]ch.ShardStat, len(after))
+	copy(stats, after)
+	for i := range stats {
+		if i >= len(before) {
+			continue
+		}
+		stats[i].Rows = sub(stats[i].Rows, before[i].Rows)
+		stats[i].UncompressedSize = sub(stats[i].UncompressedSize, before[i].UncompressedSize)
+		stats[i].CompressedSize = sub(stats[i].CompressedSize, before[i].CompressedSize)
+	}
+	return stats
+}
+
+func sub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// 按分片比对行数和压缩前的大小，返回比对结果表格以及是否存在不一致
+// 恢复后的part会在后台合并，压缩后的大小随之变化，不参与比对
+func shardDiff(m *ch.Manifest, stats []ch.ShardStat) (string, bool) {
+	mismatch := false
+	shards := len(m.Shards)
+	if len(stats) > shards {
+		shards = len(stats)
+	}
+	var data [][]interface{}
+	data = append(data, []interface{}{"shard", "host", "rows(backup)", "rows(restore)", "uncompressed(backup)", "uncompressed(restore)", "status"})
+	for i := 0; i < shards; i++ {
+		var expect ch.ShardManifest
+		var actual ch.ShardStat
+		host := ""
+		if i < len(m.Shards) {
+			expect = m.Shards[i]
+			host = expect.Host
+		}
+		if i < len(stats) {
+			actual = stats[i]
+			host = actual.Host
+		}
+		status := "OK"
+		if i >= len(m.Shards) && i < len(stats) {
+			// 恢复到分片更多的集群时，备份之后新增的分片没有备份，恢复后应该为空
+			if actual.Rows != 0 {
+				status = "MISMATCH"
+				mismatch = true
+			}
+		} else if i >= len(stats) || expect.Rows != actual.Rows || expect.UncompressedSize != actual.UncompressedSize {
+			status = "MISMATCH"
+			mismatch = true
+		}
+		data = append(data, []interface{}{i, host, expect.Rows, actual.Rows,
+			formatReadableSize(expect.UncompressedSize), formatReadableSize(actual.UncompressedSize), status})
+	}
+	tabulate := gotabulate.Create(data)
+	return tabulate.Render("grid"), mismatch
+}
+
+// 根据clickhouse BACKUP写入的.backup文件校验S3上的备份，不需要访问clickhouse节点的本地文件
+func (this *Backup) verifyBackup() error {
+	catalog, err := this.remoteCatalog()
+	if err != nil {
+		return err
+	}
+	for _, table := range this.conf.ClickHouse.Tables {
+		statekey := fmt.Sprintf("%s.%s", this.conf.ClickHouse.Database, table)
+		if this.cancelled(statekey) {
+			continue
+		}
+		partitions, err := this.remotePartitions(table)
+		if err != nil {
+			return err
+		}
+		groups := groupByPartition(catalog, this.conf.ClickHouse.Database, table)
+		this.states[statekey] = NewState(0, 0, 0, len(partitions))
+		ok := true
+		for i, p := range partitions {
+			if this.cancelled(statekey) {
+				ok = false
+				break
+			}
+			log.Logger.Infof("(%d/%d) table %s [%s] verify ", i+1, len(partitions), statekey, p)
+			entries := groups[p]
+			run, complete := this.pickSnapshot(entries)
+			if !complete {
+				err = fmt.Errorf("partition %s is not backup completely on every shard", p)
+				log.Logger.Errorf("table %s %v", statekey, err)
+				this.failure(statekey, err)
+				ok = false
+				continue
+			}
+			m, err := ch.SnapshotManifest(this.ctx, this.conf.ClickHouse.Database, table, p, run, this.conf.S3Disk)
+			if err == nil && m != nil {
+				this.states[statekey].Add(m.Rows, m.UncompressedSize, m.CompressedSize)
+			}
+			var keys []string
+			if err == nil {
+				keys, err = snapshotKeys(this.ctx, m, run, entries, this.conf.S3Disk)
+			}
+			if err != nil {
+				log.Logger.Errorf("table %s partition %s resolve backup chain failed: %v", statekey, p, err)
+				this.failure(statekey, err)
+				ok = false
+				continue
+			}
+			// 增量备份的.backup中记录了哪些文件在base中，链上的每次备份都单独校验
+			var rsize uint64
+			for _, key := range keys {
+				size, _, err := s3client.VerifyBackup(this.ctx, this.conf.S3Disk.Bucket, key, this.conf.S3Disk.CheckSum)
+				rsize += size
+				if err != nil {
+					log.Logger.Errorf("table %s partition %s %s verify failed: %v", statekey, p, key, err)
+					this.failure(statekey, err)
+					ok = false
+				}
+			}
+			this.states[statekey].Set(constant.STATE_REMOTE_SIZE, rsize)
+		}
+		if ok {
+			this.states[statekey].Success()
+		}
+		log.Logger.Infof("verify table %s done", statekey)
+	}
+	return nil
+}
+
+// 需要校验的备份：m以及它的整条备份链，没有manifest的早期备份只校验该run的每个分片
+// 其他run（包括没有完成的备份）不参与校验
+func snapshotKeys(ctx context.Context, m *ch.Manifest, run string, entries []CatalogEntry, conf config.S3) ([]string, error) {
+	var keys []string
+	if m == nil {
+		for _, e := range entries {
+			if e.Run == run {
+				keys = append(keys, e.Key())
+			}
+		}
+		return keys, nil
+	}
+	chain, err := ch.ManifestChain(ctx, m, conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chain {
+		for _, shard := range c.Shards {
+			keys = append(keys, shard.Key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotKeys(t *testing.T) {
+	entries := []CatalogEntry{
+		{Partition: "20230731", Database: "default", Table: "t", Run: "20230801T020000", Shard: 1},
+		{Partition: "20230731", Database: "default", Table: "t", Run: "20230801T020000", Shard: 2},
+		// 中断后没有完成的备份
+		{Partition: "20230731", Database: "default", Table: "t", Run: "20230802T020000", Shard: 1},
+	}
+	keys, err := snapshotKeys(context.Background(), nil, "20230801T020000", entries, config.S3{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{entries[0].Key(), entries[1].Key()}, keys)
+
+	// 有manifest时按照manifest中记录的每个分片校验
+	m := &ch.Manifest{Database: "default", Table: "t", Partition: "20230731", Run: "20230801T020000",
+		Shards: []ch.ShardManifest{{Shard: 0, Key: "k1"}, {Shard: 1, Key: "k2"}}}
+	keys, err = snapshotKeys(context.Background(), m, m.Run, entries, config.S3{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k1", "k2"}, keys)
+}
+
+func TestShardDiff(t *testing.T) {
+	m := &ch.Manifest{Shards: []ch.ShardManifest{
+		{Shard: 0, Host: "h1", Rows: 10, UncompressedSize: 100, CompressedSize: 50},
+		{Shard: 1, Host: "h2", Rows: 20, UncompressedSize: 200, CompressedSize: 80},
+	}}
+	stats := []ch.ShardStat{
+		{Shard: 0, Host: "h1", Rows: 10, UncompressedSize: 100, CompressedSize: 50},
+		{Shard: 1, Host: "h2", Rows: 20, UncompressedSize: 200, CompressedSize: 80},
+	}
+	_, mismatch := shardDiff(m, stats)
+	assert.False(t, mismatch)
+
+	// 后台合并只改变压缩后的大小
+	stats[0].CompressedSize = 45
+	_, mismatch = shardDiff(m, stats)
+	assert.False(t, mismatch)
+
+	// 备份之后新增的分片没有备份，恢复后为空
+	_, mismatch = shardDiff(m, append(stats, ch.ShardStat{Shard: 2, Host: "h3"}))
+	assert.False(t, mismatch)
+	_, mismatch = shardDiff(m, append(stats, ch.ShardStat{Shard: 2, Host: "h3", Rows: 5}))
+	assert.True(t, mismatch)
+
+	// 某个分片没有恢复
+	_, mismatch = shardDiff(m, stats[:1])
+	assert.True(t, mismatch)
+	stats[1].Rows = 21
+	_, mismatch = shardDiff(m, stats)
+	assert.True(t, mismatch)
+}
+
+func TestAppendedStats(t *testing.T) {
+	before := []ch.ShardStat{
+		{Shard: 0, Host: "h1", Rows: 5, UncompressedSize: 50, CompressedSize: 20},
+		{Shard: 1, Host: "h2", Rows: 0},
+	}
+	after := []ch.ShardStat{
+		{Shard: 0, Host: "h1", Rows: 15, UncompressedSize: 150, CompressedSize: 70},
+		{Shard: 1, Host: "h2", Rows: 20, UncompressedSize: 200, CompressedSize: 80},
+	}
+	stats := appendedStats(after, before)
+	assert.Equal(t, uint64(15), after[0].Rows)
+	m := &ch.Manifest{Shards: []ch.ShardManifest{
+		{Shard: 0, Host: "h1", Rows: 10, UncompressedSize: 100, CompressedSize: 50},
+		{Shard: 1, Host: "h2", Rows: 20, UncompressedSize: 200, CompressedSize: 80},
+	}}
+	_, mismatch := shardDiff(m, stats)
+	assert.False(t, mismatch)
+
+	// 恢复期间有数据被删除
+	after[0].Rows = 3
+	_, mismatch = shardDiff(m, appendedStats(after, before))
+	assert.True(t, mismatch)
+}
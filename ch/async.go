@@ -0,0 +1,208 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/YenchangChan/ch2s3/log"
+)
+
+const (
+	POLL_INITIAL  = 200 * time.Millisecond //提交后立即查询一次，之后从该间隔开始翻倍
+	POLL_INTERVAL = 10 * time.Second       //最大的轮询间隔，也是打印进度的间隔
+	LOST_TIMEOUT  = 10 * time.Minute       //连续查询system.backups失败超过该时间，认为该操作已经丢失
+	KILL_TIMEOUT  = 30 * time.Second
+)
+
+var (
+	exceptionCodeRe = regexp.MustCompile(`Code: (\d+)`)
+	// 早期版本的system.backups没有bytes_read
+	noBytesRead     = make(map[string]bool)
+	noBytesReadLock sync.Mutex
+)
+
+// system.backups中一个异步BACKUP/RESTORE的状态
+type AsyncStatus struct {
+	ID        string
+	Status    string
+	Error     string
+	NumFiles  uint64
+	TotalSize uint64
+	BytesRead uint64
+}
+
+func (s AsyncStatus) running() bool {
+	return s.Status == "CREATING_BACKUP" || s.Status == "RESTORING"
+}
+
+func (s AsyncStatus) success() bool {
+	return s.Status == "BACKUP_CREATED" || s.Status == "RESTORED"
+}
+
+// 失败时转换为clickhouse.Exception，保留错误码，便于调用方按照错误码处理
+func (s AsyncStatus) err() error {
+	msg := fmt.Sprintf("%s %s: %s", s.ID, s.Status, s.Error)
+	if m := exceptionCodeRe.FindStringSubmatch(s.Error); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return &clickhouse.Exception{Code: int32(code), Message: msg}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// 同一个BACKUP/RESTORE操作的ID，重连或重试时通过ID找到仍在执行的操作
+func asyncID(op, key string) string {
+	return fmt.Sprintf("ch2s3:%s:%s", op, key)
+}
+
+// 同一个操作之前提交的所有异步任务，从新到旧，重试时的ID为 id#n
+func asyncStatus(ctx context.Context, conn Conn, id string) ([]AsyncStatus, error) {
+	noBytesReadLock.Lock()
+	bytesRead := "bytes_read"
+	if noBytesRead[conn.h] {
+		bytesRead = "toUInt64(0)"
+	}
+	noBytesReadLock.Unlock()
+	query := fmt.Sprintf("SELECT id, toString(status), error, num_files, total_size, %s FROM system.backups WHERE id = '%s' OR startsWith(id, '%s#') ORDER BY start_time DESC",
+		bytesRead, id, id)
+	rows, err := conn.c.Query(ctx, query)
+	if err != nil {
+		if bytesRead == "bytes_read" && strings.Contains(err.Error(), "bytes_read") {
+			noBytesReadLock.Lock()
+			noBytesRead[conn.h] = true
+			noBytesReadLock.Unlock()
+			return asyncStatus(ctx, conn, id)
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	var statuses []AsyncStatus
+	for rows.Next() {
+		var s AsyncStatus
+		if err = rows.Scan(&s.ID, &s.Status, &s.Error, &s.NumFiles, &s.TotalSize, &s.BytesRead); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// 以ASYNC方式执行BACKUP/RESTORE并轮询system.backups直到完成，query需要以SETTINGS结尾
+// 同一个操作已经在执行时（如重连或重试）不再重复提交，直接等待它完成；expect为预计的字节数，用于估算剩余时间，未知时为0
+func execAsync(ctx context.Context, conn Conn, op, key, query string, expect uint64) error {
+	id := asyncID(op, key)
+	statuses, err := asyncStatus(ctx, conn, id)
+	if err != nil {
+		return err
+	}
+	if len(statuses) > 0 && statuses[0].running() {
+		id = statuses[0].ID
+		log.Logger.Infof("[%s]%s %s is still running, wait for it", conn.h, op, id)
+	} else {
+		if len(statuses) > 0 {
+			id = fmt.Sprintf("%s#%d", id, len(statuses))
+		}
+		query = fmt.Sprintf("%s, id = '%s' ASYNC", query, id)
+		log.Logger.Infof("%s sql => [%s]%s", op, conn.h, query)
+		if err = conn.c.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+	return waitAsync(ctx, conn, op, id, expect)
+}
+
+// 轮询异步操作的状态，打印进度、吞吐和预计剩余时间
+func waitAsync(ctx context.Context, conn Conn, op, id string, expect uint64) error {
+	start := time.Now()
+	lastOK := time.Now()
+	lastLog := time.Now()
+	var wait time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			killAsync(conn, op, id)
+			return fmt.Errorf("[%s]%s %s cancelled: %w", conn.h, op, id, ctx.Err())
+		case <-time.After(wait):
+		}
+		wait = nextPoll(wait)
+		statuses, err := asyncStatus(ctx, conn, id)
+		if err != nil {
+			// 连接断开时继续轮询，连接恢复后可以继续跟踪
+			if time.Since(lastOK) > LOST_TIMEOUT {
+				return fmt.Errorf("[%s]lost track of %s %s: %v", conn.h, op, id, err)
+			}
+			log.Logger.Warnf("[%s]query status of %s %s failed, retry later: %v", conn.h, op, id, err)
+			continue
+		}
+		lastOK = time.Now()
+		var s *AsyncStatus
+		for i := range statuses {
+			if statuses[i].ID == id {
+				s = &statuses[i]
+				break
+			}
+		}
+		if s == nil {
+			// system.backups只保存在内存中，clickhouse重启后丢失
+			return fmt.Errorf("[%s]%s %s not found in system.backups, clickhouse may be restarted", conn.h, op, id)
+		}
+		if s.success() {
+			log.Logger.Infof("[%s]%s %s done, files: %d, size: %d, elapsed: %v", conn.h, op, id, s.NumFiles,
+				s.TotalSize, time.Since(start).Round(time.Second))
+			return nil
+		}
+		if !s.running() {
+			return s.err()
+		}
+		if time.Since(lastLog) >= POLL_INTERVAL {
+			lastLog = time.Now()
+			log.Logger.Infof("[%s]%s %s %s", conn.h, op, id, asyncProgress(*s, expect, time.Since(start)))
+		}
+	}
+}
+
+// 下一次轮询的间隔，小分区很快完成，不需要等待一个完整的POLL_INTERVAL
+func nextPoll(wait time.Duration) time.Duration {
+	if wait == 0 {
+		return POLL_INITIAL
+	}
+	if wait *= 2; wait > POLL_INTERVAL {
+		wait = POLL_INTERVAL
+	}
+	return wait
+}
+
+// 取消时终止仍在执行的BACKUP/RESTORE，clickhouse不支持KILL QUERY终止BACKUP/RESTORE时，该操作会在服务端继续执行直到完成
+func killAsync(conn Conn, op, id string) {
+	query := fmt.Sprintf("KILL QUERY WHERE (startsWith(query, 'BACKUP') OR startsWith(query, 'RESTORE')) AND position(query, '%s') > 0 ASYNC", id)
+	log.Logger.Warnf("%s %s cancelled, execute sql => [%s]%s", op, id, conn.h, query)
+	c, cancel := context.WithTimeout(context.Background(), KILL_TIMEOUT)
+	defer cancel()
+	if err := conn.c.Exec(c, query); err != nil {
+		log.Logger.Errorf("[%s]kill %s %s failed, it may be still running: %v", conn.h, op, id, err)
+	}
+}
+
+// 进度描述，RESTORE按照已读取的字节数与备份大小估算，BACKUP按照已写入的字节数与预计大小估算
+func asyncProgress(s AsyncStatus, expect uint64, elapsed time.Duration) string {
+	done := s.TotalSize
+	if s.Status == "RESTORING" {
+		done, expect = s.BytesRead, s.TotalSize
+	}
+	msg := fmt.Sprintf("%s, files: %d, size: %d, elapsed: %v", s.Status, s.NumFiles, done, elapsed.Round(time.Second))
+	if done == 0 || elapsed <= 0 {
+		return msg
+	}
+	throughput := float64(done) / elapsed.Seconds()
+	msg += fmt.Sprintf(", throughput: %.2f MiB/s", throughput/1024/1024)
+	if expect > done {
+		eta := time.Duration(float64(expect-done)/throughput) * time.Second
+		msg += fmt.Sprintf(", eta: %v", eta.Round(time.Second))
+	}
+	return msg
+}
@@ -0,0 +1,46 @@
+package ch
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncStatus(t *testing.T) {
+	s := AsyncStatus{ID: "ch2s3:restore:k", Status: "RESTORE_FAILED", Error: "Code: 599. DB::Exception: Backup k not found. (BACKUP_NOT_FOUND)"}
+	assert.False(t, s.running())
+	assert.False(t, s.success())
+	var exception *clickhouse.Exception
+	assert.True(t, errors.As(s.err(), &exception))
+	assert.Equal(t, int32(599), exception.Code)
+
+	s = AsyncStatus{ID: "ch2s3:backup:k", Status: "BACKUP_FAILED", Error: "connection reset"}
+	assert.False(t, errors.As(s.err(), &exception))
+
+	s = AsyncStatus{ID: "ch2s3:backup:k", Status: "CREATING_BACKUP", NumFiles: 10, TotalSize: 100 * 1024 * 1024}
+	assert.True(t, s.running())
+	assert.Equal(t, "CREATING_BACKUP, files: 10, size: 104857600, elapsed: 10s, throughput: 10.00 MiB/s, eta: 10s",
+		asyncProgress(s, 200*1024*1024, 10*time.Second))
+
+	// RESTORE按照读取的字节数与备份大小估算
+	s = AsyncStatus{ID: "ch2s3:restore:k", Status: "RESTORING", TotalSize: 300 * 1024 * 1024, BytesRead: 100 * 1024 * 1024}
+	assert.Equal(t, "RESTORING, files: 0, size: 104857600, elapsed: 10s, throughput: 10.00 MiB/s, eta: 20s",
+		asyncProgress(s, 0, 10*time.Second))
+
+	s = AsyncStatus{ID: "ch2s3:backup:k", Status: "CREATING_BACKUP"}
+	assert.Equal(t, "CREATING_BACKUP, files: 0, size: 0, elapsed: 5s", asyncProgress(s, 100, 5*time.Second))
+}
+
+func TestNextPoll(t *testing.T) {
+	var waits []time.Duration
+	var wait time.Duration
+	for i := 0; i < 8; i++ {
+		wait = nextPoll(wait)
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond,
+		3200 * time.Millisecond, 6400 * time.Millisecond, POLL_INTERVAL, POLL_INTERVAL}, waits)
+}
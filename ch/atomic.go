@@ -0,0 +1,167 @@
+package ch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/avast/retry-go/v4"
+)
+
+var replicatedEngineRe = regexp.MustCompile(`(?i)ENGINE\s*=\s*Replicated(\w*MergeTree)\s*\(`)
+
+// 去掉Replicated引擎的zookeeper路径和副本名，影子表只存在于一个副本上，不需要同步
+func stripReplication(query string) string {
+	m := replicatedEngineRe.FindStringSubmatchIndex(query)
+	if m == nil {
+		return query
+	}
+	i := m[1]
+	skip := func() {
+		for i < len(query) && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n') {
+			i++
+		}
+	}
+	for n := 0; n < 2; n++ {
+		skip()
+		if i >= len(query) || query[i] != '\'' {
+			break
+		}
+		end := strings.IndexByte(query[i+1:], '\'')
+		if end < 0 {
+			return query
+		}
+		i += end + 2
+		skip()
+		if i < len(query) && query[i] == ',' {
+			i++
+		}
+	}
+	skip()
+	return query[:m[0]] + "ENGINE = " + query[m[2]:m[3]] + "(" + query[i:]
+}
+
+// 影子表的建表语句，与目标表的结构、分区键、排序键完全一致，REPLACE PARTITION才能成功
+func shadowCreateQuery(ctx context.Context, conn Conn, database, table, shadow string) (string, error) {
+	var query string
+	sql := fmt.Sprintf("SELECT create_table_query FROM system.tables WHERE database = '%s' AND name = '%s'", database, table)
+	if err := conn.c.QueryRow(ctx, sql).Scan(&query); err != nil {
+		return "", fmt.Errorf("[%s]get create query of %s.%s failed: %v", conn.h, database, table, err)
+	}
+	return renameCreateQuery(stripReplication(query), database, table, database, shadow)
+}
+
+// 原子恢复一个分区：每个分片先恢复到影子表中，非Replicated表每个副本都有自己的影子表，所有分片的行数都与备份一致后，再通过REPLACE PARTITION替换目标表中的分区
+// keys[i]为第i个分片需要恢复的备份链，expect[i]为manifest中记录的该分片的行数，没有manifest时为nil，不做比对
+func AtomicRestore(ctx context.Context, database, table, tdatabase, ttable, partition, run string, keys [][]string, expect []uint64, conf config.S3) error {
+	shadow := fmt.Sprintf("_ch2s3_shadow_%s_%s", ttable, run)
+	// 每个分片需要替换分区的副本，非Replicated表的每个副本都需要单独恢复和替换
+	shards := make([][]Conn, len(conns))
+	defer func() {
+		for _, targets := range shards {
+			for _, conn := range targets {
+				dropTable(conn, tdatabase, shadow)
+			}
+		}
+	}()
+
+	// step1: 恢复到影子表
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var lastErr error
+	for i := range conns {
+		if i >= len(keys) || len(keys[i]) == 0 {
+			log.Logger.Warnf("shard %d has no backup of %s.%s partition %s, skip", i+1, database, table, partition)
+			continue
+		}
+		targets, err := restoreTargets(ctx, i, tdatabase, ttable)
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		var base string
+		if len(keys[i]) > 1 {
+			base = keys[i][1]
+		}
+		key := keys[i][0]
+		for _, conn := range targets {
+			query, err := shadowCreateQuery(ctx, conn, tdatabase, ttable, shadow)
+			if err != nil {
+				wg.Wait()
+				return err
+			}
+			dropTable(conn, tdatabase, shadow)
+			log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+			if err = conn.c.Exec(ctx, query); err != nil {
+				wg.Wait()
+				return err
+			}
+			shards[i] = append(shards[i], conn)
+			wg.Add(1)
+			go func(i int, conn Conn) {
+				defer wg.Done()
+				query := genResoreSql(database, table, tdatabase, shadow, partition, key, base, conf)
+				err := retry.Do(
+					func() error {
+						err := execAsync(ctx, conn, "restore", fmt.Sprintf("%s.%s/%s", tdatabase, shadow, key), query, 0)
+						var exception *clickhouse.Exception
+						if errors.As(err, &exception) && exception.Code == 599 {
+							return fmt.Errorf("backup %s not found: %v", key, err)
+						}
+						return err
+					},
+					retry.LastErrorOnly(true),
+					retry.Context(ctx),
+					retry.Attempts(conf.RetryTimes),
+					retry.Delay(10*time.Second),
+				)
+				if err == nil && expect != nil {
+					err = checkShadow(ctx, conn, tdatabase, shadow, partition, expect[i])
+				}
+				if err != nil {
+					log.Logger.Errorf("[%s]restore %s into shadow table failed: %v", conn.h, key, err)
+					lock.Lock()
+					lastErr = err
+					lock.Unlock()
+				}
+			}(i, conn)
+		}
+	}
+	wg.Wait()
+	if lastErr != nil {
+		// 目标表没有任何变化
+		return lastErr
+	}
+
+	// step2: 所有分片都恢复成功后再替换分区
+	for _, targets := range shards {
+		for _, conn := range targets {
+			query := fmt.Sprintf("ALTER TABLE `%s`.`%s` REPLACE PARTITION '%s' FROM `%s`.`%s`", tdatabase, ttable, partition, tdatabase, shadow)
+			log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+			if err := conn.c.Exec(ctx, query); err != nil {
+				return fmt.Errorf("[%s]replace partition %s failed, replicas before it have been replaced: %v", conn.h, partition, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 影子表中该分区的行数需要与备份时一致
+func checkShadow(ctx context.Context, conn Conn, database, shadow, partition string, expect uint64) error {
+	rows, err := replicaRows(ctx, conn, database, shadow, partition)
+	if err != nil {
+		return err
+	}
+	if rows != expect {
+		return fmt.Errorf("shadow table rows %d mismatch with backup %d", rows, expect)
+	}
+	log.Logger.Infof("[%s]shadow table %s.%s partition %s rows %d match with backup", conn.h, database, shadow, partition, rows)
+	return nil
+}
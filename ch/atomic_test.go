@@ -0,0 +1,24 @@
+package ch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripReplication(t *testing.T) {
+	query := "CREATE TABLE default.events (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/default/events', '{replica}') ORDER BY id"
+	assert.Equal(t, "CREATE TABLE default.events (`id` UInt64) ENGINE = MergeTree() ORDER BY id", stripReplication(query))
+
+	query = "CREATE TABLE default.events (`id` UInt64, `ver` UInt32) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/default/events', '{replica}', ver) ORDER BY id"
+	assert.Equal(t, "CREATE TABLE default.events (`id` UInt64, `ver` UInt32) ENGINE = ReplacingMergeTree(ver) ORDER BY id", stripReplication(query))
+
+	query = "CREATE TABLE default.events (`id` UInt64) ENGINE = ReplicatedMergeTree ORDER BY id"
+	assert.Equal(t, query, stripReplication(query))
+
+	query = "CREATE TABLE default.events (`id` UInt64) ENGINE = ReplicatedMergeTree() ORDER BY id"
+	assert.Equal(t, "CREATE TABLE default.events (`id` UInt64) ENGINE = MergeTree() ORDER BY id", stripReplication(query))
+
+	query = "CREATE TABLE default.events (`id` UInt64) ENGINE = MergeTree ORDER BY id"
+	assert.Equal(t, query, stripReplication(query))
+}
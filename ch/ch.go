@@ -13,6 +13,7 @@ import (
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/constant"
 	"github.com/YenchangChan/ch2s3/log"
 	"github.com/YenchangChan/ch2s3/s3client"
 	"github.com/YenchangChan/ch2s3/utils"
@@ -25,11 +26,9 @@ type Conn struct {
 	opts utils.SshOptions
 }
 
-var (
-	conns [][]Conn
-)
+var conns [][]Conn
 
-func Connect(conf config.Ch) error {
+func Connect(ctx context.Context, conf config.Ch) error {
 	var lastErr error
 	for _, shards := range conf.Hosts {
 		var shardConns []Conn
@@ -55,7 +54,7 @@ func Connect(conf config.Ch) error {
 				lastErr = err
 			}
 
-			if err = c.Ping(context.Background()); err != nil {
+			if err = c.Ping(ctx); err != nil {
 				log.Logger.Errorf("[%s]ping failed: %v", replica, err)
 				lastErr = err
 			}
@@ -80,18 +79,18 @@ func Connect(conf config.Ch) error {
 	return nil
 }
 
-func Reconnect(conf config.Ch) error {
+func Reconnect(ctx context.Context, conf config.Ch) error {
 	Close()
-	return Connect(conf)
+	return Connect(ctx, conf)
 }
 
-func GetAvaliableConn(shardNum int) (Conn, error) {
+func GetAvaliableConn(ctx context.Context, shardNum int) (Conn, error) {
 	if shardNum < 0 || shardNum >= len(conns) {
 		return Conn{}, fmt.Errorf("shardNum is invalid")
 	}
 	var lastErr error
 	for _, conn := range conns[shardNum] {
-		if err := conn.c.Ping(context.Background()); err == nil {
+		if err := conn.c.Ping(ctx); err == nil {
 			return conn, nil
 		} else {
 			lastErr = err
@@ -100,6 +99,28 @@ func GetAvaliableConn(shardNum int) (Conn, error) {
 	return Conn{}, lastErr
 }
 
+// 指定分片中有该分区数据的节点，shards为空时为所有分片，用于按照节点限制并发
+func PartitionHosts(ctx context.Context, database, table, partition string, shards []int) ([]string, error) {
+	var hosts []string
+	for i := range conns {
+		if !inShards(shards, i) {
+			continue
+		}
+		conn, err := GetAvaliableConn(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := replicaRows(ctx, conn, database, table, partition)
+		if err != nil {
+			return nil, err
+		}
+		if rows > 0 {
+			hosts = append(hosts, conn.h)
+		}
+	}
+	return hosts, nil
+}
+
 func Close() {
 	for _, shard := range conns {
 		for _, replica := range shard {
@@ -108,7 +129,7 @@ func Close() {
 	}
 }
 
-func Size(database, table, partition string, cponly bool) (uint64, uint64, error) {
+func Size(ctx context.Context, database, table, partition string, cponly bool) (uint64, uint64, error) {
 	var lastErr error
 	var wg sync.WaitGroup
 	var lock sync.Mutex
@@ -132,14 +153,14 @@ func Size(database, table, partition string, cponly bool) (uint64, uint64, error
 		op, partition, database, table)
 	log.Logger.Debugf("execute sql => %s", query)
 	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
 			return 0, 0, err
 		}
 		go func(c driver.Conn) {
 			defer wg.Done()
 			var buncsize, bcsize uint64
-			err := c.QueryRow(context.Background(), query).Scan(&buncsize, &bcsize)
+			err := c.QueryRow(ctx, query).Scan(&buncsize, &bcsize)
 			if err != nil {
 				lastErr = err
 				return
@@ -155,7 +176,7 @@ func Size(database, table, partition string, cponly bool) (uint64, uint64, error
 	return uncompressed_size, compressed_size, lastErr
 }
 
-func Rows(database, table, partition string, cponly bool) (uint64, error) {
+func Rows(ctx context.Context, database, table, partition string, cponly bool) (uint64, error) {
 	var lastErr error
 	var wg sync.WaitGroup
 	var lock sync.Mutex
@@ -175,18 +196,19 @@ func Rows(database, table, partition string, cponly bool) (uint64, error) {
 	} else {
 		partition = "'" + partition + "'"
 	}
-	query := fmt.Sprintf("SELECT sum(rows) FROM system.parts WHERE partition %s %s AND database = '%s' AND table = '%s'",
+	// 只统计active的part，合并或者ATTACH之后残留的outdated part不计入
+	query := fmt.Sprintf("SELECT sum(rows) FROM system.parts WHERE active AND partition %s %s AND database = '%s' AND table = '%s'",
 		op, partition, database, table)
 	log.Logger.Debugf("execute sql => %s", query)
 	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
 			return 0, err
 		}
 		go func(c driver.Conn) {
 			defer wg.Done()
 			var cnt uint64
-			err := c.QueryRow(context.Background(), query).Scan(&cnt)
+			err := c.QueryRow(ctx, query).Scan(&cnt)
 			if err != nil {
 				lastErr = err
 				return
@@ -201,7 +223,7 @@ func Rows(database, table, partition string, cponly bool) (uint64, error) {
 	return count, lastErr
 }
 
-func Partitions(database, table, partition string, cponly bool) ([]string, error) {
+func Partitions(ctx context.Context, database, table, partition string, cponly bool) ([]string, error) {
 	var lastErr error
 	var wg sync.WaitGroup
 	var partitions []string
@@ -216,14 +238,14 @@ func Partitions(database, table, partition string, cponly bool) ([]string, error
 		op, partition, database, table)
 	log.Logger.Debugf("execute sql => %s", query)
 	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
 			return partitions, err
 		}
 		go func(c driver.Conn) {
 			defer wg.Done()
 
-			rows, err := c.Query(context.Background(), query)
+			rows, err := c.Query(ctx, query)
 			if err != nil {
 				lastErr = err
 				return
@@ -254,48 +276,57 @@ func Partitions(database, table, partition string, cponly bool) ([]string, error
 BACKUP TABLE default.test_ck_dataq_r77 PARTITION '20230731' TO S3('http://192.168.101.94:49000/backup/20230731', 'VdmPbwvMlH8ryeqW', '8z16tUktXpvcjjy5M4MqXvCks5MMHb63')
 SETTINGS compression_method='lz4', compression_level=3
 */
-func genBackupSql(database, table, partition, host string, conf config.S3) (string, string) {
-	var key, sql string
+func genBackupSql(database, table, partition, key, base string, conf config.S3) string {
+	var sql string
 	sql = fmt.Sprintf("BACKUP TABLE `%s`.`%s` ", database, table)
 	if partition != "" {
 		sql += fmt.Sprintf(" PARTITION '%s'", partition)
 	}
-	key = fmt.Sprintf("%s/%s.%s/%s",
-		partition, database, table, host)
 	sql += fmt.Sprintf(" TO S3('%s/%s', '%s', '%s')",
 		conf.Endpoint, key, conf.AccessKey, conf.SecretKey)
 	sql += fmt.Sprintf(" SETTINGS compression_method='%s', compression_level=%d, deduplicate_files = 0", conf.CompressMethod, conf.CompressLevel)
-	return key, sql
+	if base != "" {
+		// 增量备份，只上传base中不存在的文件
+		sql += fmt.Sprintf(", base_backup = S3('%s/%s', '%s', '%s')", conf.Endpoint, base, conf.AccessKey, conf.SecretKey)
+	}
+	return sql
 }
 
 /*
-RESTORE TABLE default.test_ck_dataq_r50 PARTITION  '20230731'
+RESTORE TABLE default.test_ck_dataq_r50 AS scratch.test_ck_dataq_r50 PARTITION  '20230731'
 FROM S3('http://192.168.101.94:49000/backup/20230731/default.test_ck_dataq_r50/192.168.101.93', 'VdmPbwvMlH8ryeqW', '8z16tUktXpvcjjy5M4MqXvCks5MMHb63') SETTINGS allow_non_empty_tables = 1
 */
-func genResoreSql(database, table, partition, host string, conf config.S3) string {
+func genResoreSql(database, table, tdatabase, ttable, partition, key, base string, conf config.S3) string {
 	var sql string
 	sql = fmt.Sprintf("RESTORE TABLE `%s`.`%s` ", database, table)
+	if tdatabase != database || ttable != table {
+		sql += fmt.Sprintf(" AS `%s`.`%s`", tdatabase, ttable)
+	}
 	if partition != "" {
 		sql += fmt.Sprintf(" PARTITION '%s'", partition)
 	}
-	sql += fmt.Sprintf(" FROM S3('%s/%s/%s.%s/%s', '%s', '%s')",
-		conf.Endpoint, partition, database, table, host, conf.AccessKey, conf.SecretKey)
+	sql += fmt.Sprintf(" FROM S3('%s/%s', '%s', '%s')",
+		conf.Endpoint, key, conf.AccessKey, conf.SecretKey)
 	sql += fmt.Sprintf(" SETTINGS allow_non_empty_tables=true")
+	if base != "" {
+		sql += fmt.Sprintf(", base_backup = S3('%s/%s', '%s', '%s')", conf.Endpoint, base, conf.AccessKey, conf.SecretKey)
+	}
 	return sql
 }
 
-func Paths(database, table, partition string, conf config.S3) (map[string]utils.PathInfo, error) {
+func Paths(ctx context.Context, database, table, partition, run string, conf config.S3, cwd string) (map[string]utils.PathInfo, error) {
 	paths := make(map[string]utils.PathInfo)
+	var lock sync.Mutex
 
 	query := fmt.Sprintf(`SELECT path FROM system.parts WHERE (database = '%s') AND (table = '%s') AND (partition = '%s')`,
 		database, table, partition)
 	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
 			return nil, err
 		}
 		log.Logger.Debugf("[%s]%s", conn.h, query)
-		rows, err := conn.c.Query(context.Background(), query)
+		rows, err := conn.c.Query(ctx, query)
 		if err != nil {
 			return nil, err
 		}
@@ -315,14 +346,27 @@ func Paths(database, table, partition string, conf config.S3) (map[string]utils.
 		if conf.CheckSum {
 			var wg sync.WaitGroup
 			var lastErr error
+			// etag模式下通过s3uploader在clickhouse节点上同时计算MD5和分段上传的ETag，避免从S3下载对象
+			// 多个分片的Paths可能同时在同一台机器上执行，每次使用不同的文件名
+			bin := uploaderPath()
+			if conf.ChecksumMode == constant.CHECKSUM_MODE_ETAG {
+				if err = u_init(ctx, conn.opts, cwd, bin); err != nil {
+					return nil, err
+				}
+			}
 			wg.Add(len(allPaths))
 			for _, p := range allPaths {
 				go func(p string) {
 					defer wg.Done()
-					log.Logger.Debugf("shell: md5sum %s", p)
-					out, err := utils.RemoteExecute(conn.opts, fmt.Sprintf("md5sum %s", p))
+					cmd := fmt.Sprintf("md5sum %s", p)
+					if conf.ChecksumMode == constant.CHECKSUM_MODE_ETAG {
+						cmd = fmt.Sprintf("%s -t -f %s --part-size %d --single-part-size %d --multiply-factor %d --multiply-threshold %d",
+							bin, p, conf.PartSize, conf.SinglePartSize, conf.PartMultiplyFactor, conf.PartMultiplyThreshold)
+					}
+					log.Logger.Debugf("shell: %s", cmd)
+					out, err := utils.RemoteExecute(conn.opts, cmd)
 					if err != nil {
-						log.Logger.Errorf("md5sum %s failed: %v", p, err)
+						log.Logger.Errorf("%s failed: %v", cmd, err)
 						lastErr = err
 						return
 					}
@@ -331,27 +375,41 @@ func Paths(database, table, partition string, conf config.S3) (map[string]utils.
 						if line == "" {
 							continue
 						}
+						// md5sum输出: md5 path, s3uploader输出: md5 etag path
 						fields := strings.Fields(line)
-						if len(fields) != 2 {
-							lastErr = fmt.Errorf("md5sum output format error: %s", line)
+						if len(fields) != 2 && len(fields) != 3 {
+							lastErr = fmt.Errorf("checksum output format error: %s", line)
 							return
 						}
 						md5sum := fields[0]
-						pp := strings.Split(fields[1], "/")
+						lpath := fields[len(fields)-1]
+						var etag string
+						if len(fields) == 3 {
+							etag = fields[1]
+						}
+						pp := strings.Split(lpath, "/")
 						partfiles := strings.Join(pp[len(pp)-2:], "/")
-						key := fmt.Sprintf("%s/%s.%s/%s/data/%s/%s/%s",
-							partition, database, table, conn.h, database, table, partfiles)
+						key := fmt.Sprintf("%s/data/%s/%s/%s",
+							snapshotKey(database, table, partition, run, i, conn.h), database, table, partfiles)
+						lock.Lock()
 						paths[key] = utils.PathInfo{
 							Host:  conn.h,
 							RPath: key,
-							LPath: fields[1],
+							LPath: lpath,
 							MD5:   md5sum,
+							ETag:  etag,
 						}
-						log.Logger.Debugf("clickhouse local path:[%s] path: %s, key: %s, checksum: %s", conn.h, fields[1], key, md5sum)
+						lock.Unlock()
+						log.Logger.Debugf("clickhouse local path:[%s] path: %s, key: %s, checksum: %s, etag: %s", conn.h, lpath, key, md5sum, etag)
 					}
 				}(p)
 			}
 			wg.Wait()
+			if conf.ChecksumMode == constant.CHECKSUM_MODE_ETAG {
+				if err = u_done(conn.opts, bin); err != nil {
+					log.Logger.Warnf("[%s]remove %s failed: %v", conn.h, bin, err)
+				}
+			}
 			if lastErr != nil {
 				return nil, lastErr
 			}
@@ -371,8 +429,8 @@ func Paths(database, table, partition string, conf config.S3) (map[string]utils.
 					continue
 				}
 				partfiles := strings.Join(pp[len(pp)-2:], "/")
-				key := fmt.Sprintf("%s/%s.%s/%s/data/%s/%s/%s",
-					partition, database, table, conn.h, database, table, partfiles)
+				key := fmt.Sprintf("%s/data/%s/%s/%s",
+					snapshotKey(database, table, partition, run, i, conn.h), database, table, partfiles)
 				paths[key] = utils.PathInfo{
 					Host:  conn.h,
 					RPath: key,
@@ -400,8 +458,8 @@ func Paths(database, table, partition string, conf config.S3) (map[string]utils.
 						continue
 					}
 					partfiles := strings.Join(pp[len(pp)-2:], "/")
-					key := fmt.Sprintf("%s/%s.%s/%s/data/%s/%s/%s",
-						partition, database, table, conn.h, database, table, partfiles)
+					key := fmt.Sprintf("%s/data/%s/%s/%s",
+						snapshotKey(database, table, partition, run, i, conn.h), database, table, partfiles)
 					paths[key] = utils.PathInfo{
 						Host:  conn.h,
 						RPath: key,
@@ -416,55 +474,91 @@ func Paths(database, table, partition string, conf config.S3) (map[string]utils.
 	return paths, nil
 }
 
-func Ch2S3(database, table, partition string, conf config.S3, cwd string) (uint64, error) {
+// 一个分片的备份结果
+type ShardResult struct {
+	Shard      int //从0开始
+	Host       string
+	Key        string
+	RemoteSize uint64
+	Manifest   *ShardManifest //备份并校验成功后该分片的manifest
+	Err        error
+}
+
+// 备份一个分区到S3，shards为需要备份的分片，从0开始，为空时备份所有分片
+// bases不为空时以bases[0]为base做增量备份，run为本次备份的ID
+// 每个分片单独重试，返回每个分片的结果，任何一个分片失败时返回error
+func Ch2S3(ctx context.Context, database, table, partition, run string, shards []int, bases []*Manifest, conf config.S3, cwd string) ([]ShardResult, error) {
 	var wg sync.WaitGroup
-	var lastErr error
-	var rsize uint64
-	var lock sync.Mutex
-	wg.Add(len(conns))
-	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+	if len(shards) == 0 {
+		for i := range conns {
+			shards = append(shards, i)
+		}
+	}
+	results := make([]ShardResult, len(shards))
+	for idx, i := range shards {
+		result := &results[idx]
+		result.Shard = i
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
-			return rsize, err
+			result.Err = fmt.Errorf("shard %d has no available replica: %v", i+1, err)
+			continue
 		}
-		go func(conn Conn) {
+		result.Host = conn.h
+		key := snapshotKey(database, table, partition, run, i, conn.h)
+		result.Key = key
+		// keys为该分片的整条备份链，增量备份只包含base中没有的文件，需要结合整条链校验
+		keys := []string{key}
+		var base string
+		if len(bases) > 0 {
+			baseKeys, err := chainKeys(bases, i, database, table, partition, conn.h)
+			if err != nil {
+				result.Err = err
+				continue
+			}
+			keys = append(keys, baseKeys...)
+			base = baseKeys[0]
+		}
+		wg.Add(1)
+		go func(shard int, conn Conn) {
 			defer wg.Done()
-			key, query := genBackupSql(database, table, partition, conn.h, conf)
+			query := genBackupSql(database, table, partition, key, base, conf)
 			if !conf.Upload {
 				log.Logger.Infof("backup sql => [%s]%s", conn.h, query)
 			}
 			if err := retry.Do(
 				func() error {
-					//step1: 获取表数据
+					//step1: 获取表数据, 只有local校验模式下需要
 					log.Logger.Infof("[%s]step1 -> init", conn.h)
-					paths, err := Paths(database, table, partition, conf)
-					if err != nil {
-						return err
+					var paths map[string]utils.PathInfo
+					var err error
+					if conf.VerifyMode == constant.VERIFY_MODE_LOCAL {
+						paths, err = Paths(ctx, database, table, partition, run, conf, cwd)
+						if err != nil {
+							return err
+						}
 					}
 					//step2: 备份表
 					again := false
 					log.Logger.Infof("[%s]step2 -> backup", conn.h)
-					ePaths, s3size, cnt, err := s3client.CheckSum(conn.h, conf.Bucket, key, paths, conf)
+					ePaths, s3size, cnt, err := checkBackup(ctx, conn, database, table, partition, keys, paths, conf)
 					if err == nil {
 						//说明之前备份成功过，不需要再次备份
-						lock.Lock()
-						rsize += s3size
-						lock.Unlock()
+						result.RemoteSize = s3size
 						log.Logger.Infof("[%s]%s %s already backup success before", conn.h, key, partition)
 						return nil
 					}
-					if cnt == 0 || !conf.Upload {
+					if cnt == 0 || !conf.Upload || conf.VerifyMode != constant.VERIFY_MODE_LOCAL {
 						// cnt = 0, 说明所有的数据在S3上都不存在，此时需要BACKUP一下，避免RESTORE失败
+						expect, _ := replicaBytes(ctx, conn, database, table, partition)
 					AGAIN:
-						log.Logger.Infof("backup query: %s", query)
-						err = conn.c.Exec(context.Background(), query)
+						err = execAsync(ctx, conn, "backup", key, query, expect)
 						if err != nil {
 							log.Logger.Errorf("[%s]backup failed: %v", conn.h, err)
 							var exception *clickhouse.Exception
 							if errors.As(err, &exception) {
 								if exception.Code == 598 && conf.CleanIfFail {
 									if !again {
-										err = s3client.Remove(conf.Bucket, key)
+										err = s3client.Remove(ctx, conf.Bucket, key+"/", conf.DeleteWorkers)
 										if err != nil {
 											log.Logger.Errorf("[%s] clean data %s from s3 failed:%v", conn.h, key, err)
 										}
@@ -476,109 +570,273 @@ func Ch2S3(database, table, partition string, conf config.S3, cwd string) (uint6
 							return err
 						} else {
 							//backup 成功，需要二次check
-							ePaths, s3size, _, err = s3client.CheckSum(conn.h, conf.Bucket, key, paths, conf)
+							ePaths, s3size, _, err = checkBackup(ctx, conn, database, table, partition, keys, paths, conf)
 						}
 					}
 
 					//step3: 校验数据
 					log.Logger.Infof("[%s]step3 -> check sum", conn.h)
+					if err != nil && conf.VerifyMode != constant.VERIFY_MODE_LOCAL {
+						return err
+					}
 					if err != nil && conf.Upload {
 						log.Logger.Debugf("[%s] check sum %s from s3 failed:%v, try to upload local file", conn.h, key, err)
 						//step4: 校验失败，尝试手动备份数据
 						log.Logger.Infof("[%s]step4 -> upload data", conn.h)
-						if err := UploadFiles(conn.opts, ePaths, conf, cwd); err != nil {
+						if err := UploadFiles(ctx, conn.opts, ePaths, conf, cwd); err != nil {
 							return err
 						}
-						ePaths, s3size, _, err = s3client.CheckSum(conn.h, conf.Bucket, key, paths, conf)
+						ePaths, s3size, _, err = s3client.CheckSum(ctx, conn.h, conf.Bucket, key, paths, conf)
 						if err != nil {
 							log.Logger.Errorf("[%s] check sum %s from s3 failed:%v", conn.h, key, err)
 							return err
 						}
 					}
-					lock.Lock()
-					rsize += s3size
-					lock.Unlock()
+					result.RemoteSize = s3size
 
 					log.Logger.Infof("[%s]%s %s backup success", conn.h, key, partition)
 					return nil
 				},
 				retry.LastErrorOnly(true),
+				retry.Context(ctx),
 				retry.Attempts(conf.RetryTimes),
 				retry.Delay(10*time.Second),
 			); err != nil {
 				if conf.CleanIfFail {
-					// 删除s3上的不完整的数据
+					// 删除s3上的不完整的数据，被取消时也需要删除
 					log.Logger.Warnf("[%s] %v, try to clean", conn.h, err)
-					err2 := s3client.Remove(conf.Bucket, key)
+					err2 := s3client.Cleanup(conf.Bucket, key+"/", conf.DeleteWorkers)
 					if err2 != nil {
 						log.Logger.Errorf("[%s] clean data %s from s3 failed:%v", conn.h, key, err2)
 					}
 				} else {
 					log.Logger.Errorf("[%s] %v", conn.h, err)
 				}
-				lastErr = err
+				result.Err = err
 				return
 			}
-		}(conn)
+			m, err := shardManifest(ctx, conn, shard, database, table, partition, key, bases, conf)
+			if err != nil {
+				result.Err = fmt.Errorf("collect manifest of shard %d failed: %v", shard+1, err)
+				return
+			}
+			result.Manifest = &m
+		}(i, conn)
 	}
 	wg.Wait()
-	return rsize, lastErr
+	return results, shardsError(results)
 }
 
-func Restore(database, table, partition string, conf config.S3) error {
+// 汇总失败的分片
+func shardsError(results []ShardResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("shard %d [%s]: %v", r.Shard+1, r.Host, r.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d shards failed, %s", len(failed), len(results), strings.Join(failed, "; "))
+}
+
+// 从S3恢复一个分区，keys[i]为第i个分片需要恢复的备份链，keys[i][0]为需要恢复的备份，其余为它的base
+// 分片的备份按照分片编号恢复到当前该分片可用的副本上，与备份时使用的host无关，恢复到tdatabase.ttable中
+// 非Replicated表恢复到该分片的每个副本上，Replicated表只恢复到一个副本，依赖复制同步到其他副本
+func Restore(ctx context.Context, database, table, tdatabase, ttable, partition string, keys [][]string, conf config.S3) error {
 	var wg sync.WaitGroup
+	var lock sync.Mutex
 	var lastErr error
-	wg.Add(len(conns))
+	restore := func(conn Conn, key, base string) {
+		defer wg.Done()
+		query := genResoreSql(database, table, tdatabase, ttable, partition, key, base, conf)
+		if err := retry.Do(
+			func() error {
+				err := execAsync(ctx, conn, "restore", fmt.Sprintf("%s.%s/%s", tdatabase, ttable, key), query, 0)
+				if err != nil {
+					var exception *clickhouse.Exception
+					if errors.As(err, &exception) && exception.Code == 599 {
+						return fmt.Errorf("backup %s not found: %v", key, err)
+					}
+					return err
+				}
+				return nil
+			},
+			retry.LastErrorOnly(true),
+			retry.Context(ctx),
+			retry.Attempts(conf.RetryTimes),
+			retry.Delay(10*time.Second),
+		); err != nil {
+			log.Logger.Errorf("[%s]restore %s failed: %v", conn.h, key, err)
+			lock.Lock()
+			lastErr = err
+			lock.Unlock()
+		}
+	}
 	for i := range conns {
-		conn, err := GetAvaliableConn(i)
+		if i >= len(keys) || len(keys[i]) == 0 {
+			// 该分片是备份之后才扩容的，没有需要恢复的数据
+			log.Logger.Warnf("shard %d has no backup of %s.%s partition %s, skip", i+1, database, table, partition)
+			continue
+		}
+		targets, err := restoreTargets(ctx, i, tdatabase, ttable)
 		if err != nil {
 			return err
 		}
-		go func(conn Conn) {
-			defer wg.Done()
-			query := genResoreSql(database, table, partition, conn.h, conf)
-			log.Logger.Infof("restore sql => [%s]%s", conn.h, query)
-			if err := retry.Do(
-				func() error {
-					err := conn.c.Exec(context.Background(), query)
-					if err != nil {
-						var exception *clickhouse.Exception
-						if errors.As(err, &exception) {
-							if exception.Code == 599 {
-								// 说明以前这个节点可能不存在，是新扩容的节点，此时不算失败
-								// 当然如果分片缩容副本了的场景不包含在内，此种情况解决不了
-								return nil
-							}
-						}
-						return err
-					}
-					return nil
-				},
-				retry.LastErrorOnly(true),
-				retry.Attempts(conf.RetryTimes),
-				retry.Delay(10*time.Second),
-			); err != nil {
-				lastErr = err
-				return
-			}
-		}(conn)
+		var base string
+		if len(keys[i]) > 1 {
+			base = keys[i][1]
+		}
+		key := keys[i][0]
+		for _, conn := range targets {
+			wg.Add(1)
+			go restore(conn, key, base)
+		}
 	}
 	wg.Wait()
 	return lastErr
 }
 
-func Clean(database, table, partition string) error {
-	for i := range conns {
-		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` DROP PARTITION '%s'", database, table, partition)
-		conn, err := GetAvaliableConn(i)
-		log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+// 删除指定分片上本地已经备份的分区，shards为空时为所有分片，Replicated表只在一个副本上执行并等待所有副本同步，其他引擎需要在每个副本上执行
+// 删除后确认这些分片的所有副本上都已经没有该分区的数据
+func Clean(ctx context.Context, database, table, partition string, shards []int) error {
+	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` DROP PARTITION '%s'", database, table, partition)
+	for i, shard := range conns {
+		if !inShards(shards, i) {
+			continue
+		}
+		conn, err := GetAvaliableConn(ctx, i)
 		if err != nil {
 			return err
 		}
-		err = conn.c.Exec(context.Background(), query)
+		replicated, err := isReplicated(ctx, conn, database, table)
 		if err != nil {
 			return err
 		}
+		if replicated {
+			// 等待所有副本都执行完成
+			sctx := clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+				"replication_alter_partitions_sync": 2,
+			}))
+			log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+			if err = conn.c.Exec(sctx, query); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, replica := range shard {
+			log.Logger.Infof("execute sql => [%s]%s", replica.h, query)
+			if err = replica.c.Exec(ctx, query); err != nil {
+				return fmt.Errorf("[%s]%v", replica.h, err)
+			}
+		}
 	}
-	return nil
+	return verifyDropped(ctx, database, table, partition, shards)
+}
+
+// shards为空表示所有分片
+func inShards(shards []int, shard int) bool {
+	if len(shards) == 0 {
+		return true
+	}
+	for _, s := range shards {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// 集群的分片数
+func Shards() int {
+	return len(conns)
+}
+
+// 校验S3上的备份，backup模式下只依赖.backup文件，parts模式下只依赖system.parts，都不需要ssh
+// keys[0]为需要校验的备份，其余为增量备份的base，local模式不支持增量备份
+func checkBackup(ctx context.Context, conn Conn, database, table, partition string, keys []string, paths map[string]utils.PathInfo, conf config.S3) (map[string]utils.PathInfo, uint64, int, error) {
+	switch conf.VerifyMode {
+	case constant.VERIFY_MODE_BACKUP:
+		// .backup文件中记录了哪些文件在base中
+		rsize, cnt, err := s3client.VerifyBackup(ctx, conf.Bucket, keys[0], conf.CheckSum)
+		return nil, rsize, cnt, err
+	case constant.VERIFY_MODE_PARTS:
+		rsize, cnt, err := verifyParts(ctx, conn, database, table, partition, keys, conf)
+		return nil, rsize, cnt, err
+	}
+	if len(keys) > 1 {
+		return nil, 0, -1, fmt.Errorf("verify mode %s does not support incremental backup", conf.VerifyMode)
+	}
+	return s3client.CheckSum(ctx, conn.h, conf.Bucket, keys[0], paths, conf)
+}
+
+// 校验S3上已有的备份与本地数据是否一致，不做任何备份操作，chain为最新的备份以及它的所有base
+func Verify(ctx context.Context, database, table, partition string, chain []*Manifest, conf config.S3, cwd string) (uint64, error) {
+	var rsize uint64
+	var lastErr error
+	var paths map[string]utils.PathInfo
+	var err error
+	if conf.VerifyMode == constant.VERIFY_MODE_LOCAL {
+		var run string
+		if len(chain) > 0 {
+			run = chain[0].Run
+		}
+		paths, err = Paths(ctx, database, table, partition, run, conf, cwd)
+		if err != nil {
+			return rsize, err
+		}
+	}
+	for i := range conns {
+		conn, err := GetAvaliableConn(ctx, i)
+		if err != nil {
+			return rsize, err
+		}
+		keys, err := chainKeys(chain, i, database, table, partition, conn.h)
+		if err != nil {
+			return rsize, err
+		}
+		_, s3size, _, err := checkBackup(ctx, conn, database, table, partition, keys, paths, conf)
+		rsize += s3size
+		if err != nil {
+			log.Logger.Errorf("[%s]%s %s verify failed: %v", conn.h, keys[0], partition, err)
+			lastErr = err
+			continue
+		}
+		log.Logger.Infof("[%s]%s %s verify success", conn.h, keys[0], partition)
+	}
+	return rsize, lastErr
+}
+
+type CheckItem struct {
+	Host string
+	Item string
+	Err  error
+}
+
+// 检查每个副本的clickhouse连接，ssh连接，以及需要备份的表是否存在，不需要ssh的校验模式下跳过ssh检查
+func Check(ctx context.Context, database string, tables []string, ssh bool) []CheckItem {
+	var items []CheckItem
+	for _, shard := range conns {
+		for _, conn := range shard {
+			err := conn.c.Ping(ctx)
+			items = append(items, CheckItem{Host: conn.h, Item: "clickhouse", Err: err})
+			if err == nil {
+				for _, table := range tables {
+					var cnt uint64
+					query := fmt.Sprintf("SELECT count() FROM system.tables WHERE database = '%s' AND name = '%s'", database, table)
+					err = conn.c.QueryRow(ctx, query).Scan(&cnt)
+					if err == nil && cnt == 0 {
+						err = fmt.Errorf("table %s.%s not exist", database, table)
+					}
+					items = append(items, CheckItem{Host: conn.h, Item: fmt.Sprintf("table %s.%s", database, table), Err: err})
+				}
+			}
+			if ssh {
+				_, err = utils.RemoteExecute(conn.opts, "echo ok")
+				items = append(items, CheckItem{Host: conn.h, Item: "ssh", Err: err})
+			}
+		}
+	}
+	return items
 }
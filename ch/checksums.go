@@ -0,0 +1,180 @@
+package ch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+
+	"github.com/ClickHouse/ch-go/compress"
+)
+
+const CHECKSUMS_HEADER = "checksums format version: "
+
+// checksums.txt中记录的一个文件
+type FileChecksum struct {
+	Size uint64
+	Hash [16]byte //clickhouse计算的CityHash128，低64位在前
+}
+
+// 与s3client计算的checksum格式一致，高64位在前
+func (c FileChecksum) Hex() string {
+	return fmt.Sprintf("%016x%016x", binary.LittleEndian.Uint64(c.Hash[8:]), binary.LittleEndian.Uint64(c.Hash[:8]))
+}
+
+// 解析part的checksums.txt，返回文件名到大小和hash的映射
+// 文件名为磁盘上的实际文件名，开启replace_long_file_name_to_hash时为替换后的hash
+// version 3为二进制格式，version 4为clickhouse压缩后的二进制格式
+func parseChecksums(data []byte) (map[string]FileChecksum, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	var version int
+	if _, err := fmt.Fscanf(r, CHECKSUMS_HEADER+"%d\n", &version); err != nil {
+		return nil, fmt.Errorf("invalid checksums.txt: %v", err)
+	}
+	switch version {
+	case 3:
+	case 4:
+		r = bufio.NewReader(compress.NewReader(r))
+	default:
+		return nil, fmt.Errorf("unsupported checksums.txt format version %d", version)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]FileChecksum, count)
+	for i := uint64(0); i < count; i++ {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		var c FileChecksum
+		if c.Size, err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(r, c.Hash[:]); err != nil {
+			return nil, err
+		}
+		compressed, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if compressed != 0 {
+			// 压缩前的大小和hash，不参与校验
+			if _, err = binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+			var hash [16]byte
+			if _, err = io.ReadFull(r, hash[:]); err != nil {
+				return nil, err
+			}
+		}
+		checksums[string(name)] = c
+	}
+	return checksums, nil
+}
+
+// 与clickhouse的MinimalisticDataPartChecksums::computeTotalChecksums一致，
+// 按文件名顺序对每个文件的名称和hash计算SipHash，即system.parts中的hash_of_all_files
+// 不同版本的clickhouse输出时高低64位的顺序不同，两种顺序都返回
+func hashOfAllFiles(checksums map[string]FileChecksum) []string {
+	var names []string
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := newSipHash()
+	var buf [8]byte
+	for _, name := range names {
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(name)))
+		h.Write(buf[:])
+		h.Write([]byte(name))
+		hash := checksums[name].Hash
+		h.Write(hash[:])
+	}
+	low, high := h.Sum128()
+	return []string{fmt.Sprintf("%016x%016x", low, high), fmt.Sprintf("%016x%016x", high, low)}
+}
+
+// clickhouse的SipHash，key为0，128位的结果为(v0^v1, v2^v3)
+type sipHash struct {
+	v0, v1, v2, v3 uint64
+	buf            [8]byte
+	pos            int
+	cnt            uint64
+}
+
+func newSipHash() *sipHash {
+	return newSipHashKey(0, 0)
+}
+
+func newSipHashKey(k0, k1 uint64) *sipHash {
+	return &sipHash{
+		v0: 0x736f6d6570736575 ^ k0,
+		v1: 0x646f72616e646f6d ^ k1,
+		v2: 0x6c7967656e657261 ^ k0,
+		v3: 0x7465646279746573 ^ k1,
+	}
+}
+
+func (h *sipHash) round() {
+	h.v0 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 13)
+	h.v1 ^= h.v0
+	h.v0 = bits.RotateLeft64(h.v0, 32)
+	h.v2 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 16)
+	h.v3 ^= h.v2
+	h.v0 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 21)
+	h.v3 ^= h.v0
+	h.v2 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 17)
+	h.v1 ^= h.v2
+	h.v2 = bits.RotateLeft64(h.v2, 32)
+}
+
+func (h *sipHash) compress(m uint64) {
+	h.v3 ^= m
+	h.round()
+	h.round()
+	h.v0 ^= m
+}
+
+func (h *sipHash) Write(p []byte) {
+	h.cnt += uint64(len(p))
+	for len(p) > 0 {
+		n := copy(h.buf[h.pos:], p)
+		h.pos += n
+		p = p[n:]
+		if h.pos == 8 {
+			h.compress(binary.LittleEndian.Uint64(h.buf[:]))
+			h.pos = 0
+		}
+	}
+}
+
+func (h *sipHash) finalize() {
+	var last [8]byte
+	copy(last[:], h.buf[:h.pos])
+	last[7] = byte(h.cnt)
+	h.compress(binary.LittleEndian.Uint64(last[:]))
+	h.v2 ^= 0xff
+	h.round()
+	h.round()
+	h.round()
+	h.round()
+}
+
+// 返回低64位和高64位
+func (h *sipHash) Sum128() (uint64, uint64) {
+	h.finalize()
+	return h.v0 ^ h.v1, h.v2 ^ h.v3
+}
@@ -1,34 +1,66 @@
 package ch
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 
 	"github.com/YenchangChan/ch2s3/config"
 	"github.com/YenchangChan/ch2s3/log"
 	"github.com/YenchangChan/ch2s3/utils"
 )
 
-func u_init(opts utils.SshOptions, cwd string) error {
+const UPLOADER = "/tmp/s3uploader"
+
+var (
+	uploaderSeq int64
+	// 正在使用的s3uploader，取消时终止这些进程
+	uploaders     = make(map[string]utils.SshOptions)
+	uploadersLock sync.Mutex
+)
+
+// 每次上传使用不同的路径，同一个节点上并发上传时不会互相删除
+func uploaderPath() string {
+	return fmt.Sprintf("%s_%d_%d", UPLOADER, os.Getpid(), atomic.AddInt64(&uploaderSeq, 1))
+}
+
+func u_init(ctx context.Context, opts utils.SshOptions, cwd, bin string) error {
+	uploadersLock.Lock()
+	uploaders[bin] = opts
+	uploadersLock.Unlock()
+	// 先登记再检查，取消之后不会再启动新的s3uploader
+	if err := ctx.Err(); err != nil {
+		uploadersLock.Lock()
+		delete(uploaders, bin)
+		uploadersLock.Unlock()
+		return err
+	}
 	//上传s3uploader 到对端机器
-	if err := utils.ScpUploadFile(path.Join(cwd, "bin", "s3uploader"), "/tmp/s3uploader", opts); err != nil {
+	if err := utils.ScpUploadFile(path.Join(cwd, "bin", "s3uploader"), bin, opts); err != nil {
 		return err
 	}
-	if _, err := utils.RemoteExecute(opts, "chmod u+x /tmp/s3uploader"); err != nil {
+	if _, err := utils.RemoteExecute(opts, fmt.Sprintf("chmod u+x %s", bin)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func u_done(opts utils.SshOptions) error {
-	if _, err := utils.RemoteExecute(opts, "rm -f /tmp/s3uploader"); err != nil {
+func u_done(opts utils.SshOptions, bin string) error {
+	uploadersLock.Lock()
+	delete(uploaders, bin)
+	uploadersLock.Unlock()
+	if _, err := utils.RemoteExecute(opts, fmt.Sprintf("rm -f %s", bin)); err != nil {
 		return err
 	}
 	return nil
 }
 
-func Upload(opts utils.SshOptions, paths map[string]utils.PathInfo, conf config.S3, cwd string) error {
-	if err := u_init(opts, cwd); err != nil {
+func Upload(ctx context.Context, opts utils.SshOptions, paths map[string]utils.PathInfo, conf config.S3, cwd string) error {
+	bin := uploaderPath()
+	if err := u_init(ctx, opts, cwd, bin); err != nil {
 		return err
 	}
 	//执行s3uploader 命令
@@ -59,23 +91,27 @@ func Upload(opts utils.SshOptions, paths map[string]utils.PathInfo, conf config.
 
 	for _, v := range pathInfo {
 		log.Logger.Debugf("[%s]lpath: %s, rpath: %v", opts.Host, v.LPath, v.RPath)
-		cmd := fmt.Sprintf("/tmp/s3uploader -b %s -f %s -a %s -s %s -r %s -e %s",
-			v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
+		cmd := fmt.Sprintf("%s -b %s -f %s -a %s -s %s -r %s -e %s",
+			bin, v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
 		log.Logger.Infof("[%s]cmd: %s", opts.Host, cmd)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if _, err := utils.RemoteExecute(opts, cmd); err != nil {
 			return err
 		}
 
 	}
 	//删除s3uploader工具
-	if err := u_done(opts); err != nil {
+	if err := u_done(opts, bin); err != nil {
 		return err
 	}
 	return nil
 }
 
-func UploadFiles(opts utils.SshOptions, paths map[string]utils.PathInfo, conf config.S3, cwd string) error {
-	if err := u_init(opts, cwd); err != nil {
+func UploadFiles(ctx context.Context, opts utils.SshOptions, paths map[string]utils.PathInfo, conf config.S3, cwd string) error {
+	bin := uploaderPath()
+	if err := u_init(ctx, opts, cwd, bin); err != nil {
 		return err
 	}
 	pathInfo := make(map[string]utils.PathInfo)
@@ -107,16 +143,19 @@ func UploadFiles(opts utils.SshOptions, paths map[string]utils.PathInfo, conf co
 
 	for _, v := range pathInfo {
 		log.Logger.Infof("[%s]s3uploader rpath: %v", opts.Host, v.RPath)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if conf.CheckCnt {
-			cmd := fmt.Sprintf("for lpath in `ls %s`; do /tmp/s3uploader -b %s -f %s$lpath -a %s -s %s -r %s -e %s; done",
-				v.LPath, v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
+			cmd := fmt.Sprintf("for lpath in `ls %s`; do %s -b %s -f %s$lpath -a %s -s %s -r %s -e %s; done",
+				v.LPath, bin, v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
 			log.Logger.Infof("[%s]cmd: %s", opts.Host, cmd)
 			if _, err := utils.RemoteExecute(opts, cmd); err != nil {
 				return err
 			}
 		} else {
-			cmd := fmt.Sprintf("/tmp/s3uploader -b %s -f %s -a %s -s %s -r %s -e %s",
-				v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
+			cmd := fmt.Sprintf("%s -b %s -f %s -a %s -s %s -r %s -e %s",
+				bin, v.RPath, v.LPath, conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
 			log.Logger.Debugf("[%s]cmd: %s", opts.Host, cmd)
 			if _, err := utils.RemoteExecute(opts, cmd); err != nil {
 				return err
@@ -124,8 +163,25 @@ func UploadFiles(opts utils.SshOptions, paths map[string]utils.PathInfo, conf co
 		}
 
 	}
-	if err := u_done(opts); err != nil {
+	if err := u_done(opts, bin); err != nil {
 		return err
 	}
 	return nil
 }
+
+// 收到SIGINT/SIGTERM时终止远程节点上仍在运行的s3uploader并删除它
+func KillUploaders() {
+	uploadersLock.Lock()
+	defer uploadersLock.Unlock()
+	for bin, opts := range uploaders {
+		// 使用[/]避免匹配到执行pkill的shell本身，末尾的空格避免匹配到序号为前缀的其他s3uploader
+		cmd := fmt.Sprintf("pkill -f '[/]%s ' || true", bin[1:])
+		log.Logger.Warnf("[%s]cancelled, kill s3uploader: %s", opts.Host, cmd)
+		if _, err := utils.RemoteExecute(opts, cmd); err != nil {
+			log.Logger.Warnf("[%s]kill s3uploader %s failed: %v", opts.Host, bin, err)
+		}
+		if _, err := utils.RemoteExecute(opts, fmt.Sprintf("rm -f %s", bin)); err != nil {
+			log.Logger.Warnf("[%s]remove s3uploader %s failed: %v", opts.Host, bin, err)
+		}
+	}
+}
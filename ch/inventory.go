@@ -0,0 +1,194 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// 根据system.parts得到的一个part的信息
+type PartInventory struct {
+	Name     string
+	PartType string
+	Rows     uint64
+	Hash     string //hash_of_all_files，checksums.txt中所有文件的名称和hash计算得到
+}
+
+// S3上part目录下的一个文件
+type RemoteFile struct {
+	Key  string
+	Size uint64
+}
+
+// 每个part都必须存在的文件
+var requiredPartFiles = []string{"checksums.txt", "columns.txt"}
+
+// 与clickhouse的escapeForFileName一致，除字母数字和下划线外都转义为%XX
+func escapeForFileName(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+// 只通过SQL查询一个分片上该分区所有active的part
+func partInventory(ctx context.Context, conn Conn, database, table, partition string) (map[string]*PartInventory, error) {
+	inventory := make(map[string]*PartInventory)
+	query := fmt.Sprintf("SELECT name, part_type, rows, hash_of_all_files FROM system.parts WHERE active AND database = '%s' AND table = '%s' AND partition = '%s'",
+		database, table, partition)
+	log.Logger.Debugf("[%s]%s", conn.h, query)
+	rows, err := conn.c.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part PartInventory
+		if err = rows.Scan(&part.Name, &part.PartType, &part.Rows, &part.Hash); err != nil {
+			return nil, err
+		}
+		inventory[part.Name] = &part
+	}
+	return inventory, nil
+}
+
+// 校验S3上一个part目录下的文件，files为文件名到S3对象的映射
+// 先下载part的checksums.txt，与clickhouse的hash_of_all_files比对，确认与clickhouse上的part一致，
+// 再以其中记录的文件(包括replace_long_file_name_to_hash替换后的文件名)为清单比对S3上的文件和大小，
+// deep为true时还会下载每个文件校验checksums.txt中记录的hash
+func verifyPart(ctx context.Context, part *PartInventory, files map[string]RemoteFile, bucket string, deep bool) error {
+	if len(files) == 0 {
+		return fmt.Errorf("part %s not found on s3", part.Name)
+	}
+	for _, f := range requiredPartFiles {
+		if _, ok := files[f]; !ok {
+			return fmt.Errorf("part %s file %s not found on s3", part.Name, f)
+		}
+	}
+	data, err := s3client.GetObject(ctx, bucket, files["checksums.txt"].Key)
+	if err != nil {
+		return err
+	}
+	checksums, err := parseChecksums(data)
+	if err != nil {
+		return fmt.Errorf("part %s parse checksums.txt failed: %v", part.Name, err)
+	}
+	if err = checkPart(part, checksums, files); err != nil {
+		return err
+	}
+	if !deep {
+		return nil
+	}
+	for name, c := range checksums {
+		hash, err := s3client.ObjectChecksum(ctx, bucket, files[name].Key)
+		if err != nil {
+			return err
+		}
+		if hash != c.Hex() {
+			return fmt.Errorf("part %s file %s checksum mismatch, expect %s, but got %s", part.Name, name, c.Hex(), hash)
+		}
+	}
+	return nil
+}
+
+// 比对checksums.txt与clickhouse上的part，以及S3上每个文件是否存在且大小一致
+func checkPart(part *PartInventory, checksums map[string]FileChecksum, files map[string]RemoteFile) error {
+	if part.Hash != "" {
+		matched := false
+		hashes := hashOfAllFiles(checksums)
+		for _, hash := range hashes {
+			if strings.EqualFold(hash, part.Hash) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("part %s checksums.txt on s3 mismatch with clickhouse, expect %s, but got %s", part.Name, part.Hash, hashes[0])
+		}
+	}
+	if _, ok := checksums["count.txt"]; !ok && part.Rows > 0 {
+		return fmt.Errorf("part %s file count.txt not found in checksums.txt", part.Name)
+	}
+	for name, c := range checksums {
+		f, ok := files[name]
+		if !ok {
+			return fmt.Errorf("part %s file %s not found on s3", part.Name, name)
+		}
+		if f.Size != c.Size {
+			return fmt.Errorf("part %s file %s size mismatch, expect %d, but got %d", part.Name, name, c.Size, f.Size)
+		}
+	}
+	return nil
+}
+
+// 只依赖clickhouse的元数据(system.parts, system.parts_columns)校验S3上的备份，不需要ssh
+// keys[0]为需要校验的备份，其余为增量备份的base
+func verifyParts(ctx context.Context, conn Conn, database, table, partition string, keys []string, conf config.S3) (uint64, int, error) {
+	inventory, err := partInventory(ctx, conn, database, table, partition)
+	if err != nil {
+		return 0, -1, err
+	}
+	var rsize uint64
+	var cnt int
+	remote := make(map[string]map[string]RemoteFile)
+	// 增量备份中没有变化的文件在base中，同一个文件以较新的备份为准
+	for i, key := range keys {
+		prefix := fmt.Sprintf("%s/data/%s/%s/", key, escapeForFileName(database), escapeForFileName(table))
+		err = s3client.Walk(ctx, conf.Bucket, key+"/", func(object *s3.Object) error {
+			if i == 0 {
+				rsize += uint64(*object.Size)
+				cnt++
+			}
+			if !strings.HasPrefix(*object.Key, prefix) {
+				return nil
+			}
+			fields := strings.SplitN(strings.TrimPrefix(*object.Key, prefix), "/", 2)
+			if len(fields) != 2 {
+				return nil
+			}
+			if _, ok := remote[fields[0]]; !ok {
+				remote[fields[0]] = make(map[string]RemoteFile)
+			}
+			if _, ok := remote[fields[0]][fields[1]]; !ok {
+				remote[fields[0]][fields[1]] = RemoteFile{Key: *object.Key, Size: uint64(*object.Size)}
+			}
+			return nil
+		})
+		if err != nil {
+			return rsize, -1, err
+		}
+	}
+	var names []string
+	for name := range inventory {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lastErr error
+	for _, name := range names {
+		part := inventory[name]
+		if err := verifyPart(ctx, part, remote[name], conf.Bucket, conf.CheckSum); err != nil {
+			log.Logger.Warnf("[%s]%v", conn.h, err)
+			lastErr = err
+			continue
+		}
+		log.Logger.Debugf("[%s]part %s(%s) matched %d files on s3", conn.h, name, part.PartType, len(remote[name]))
+	}
+	for name := range remote {
+		if _, ok := inventory[name]; !ok {
+			log.Logger.Warnf("[%s]part %s on s3 is not active on clickhouse", conn.h, name)
+		}
+	}
+	log.Logger.Infof("[%s] %s has %d parts on clickhouse, %d parts on s3", conn.h, keys[0], len(inventory), len(remote))
+	return rsize, cnt, lastErr
+}
@@ -0,0 +1,113 @@
+package ch
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/ClickHouse/ch-go/compress"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeForFileName(t *testing.T) {
+	assert.Equal(t, "test_ck_dataq_r77", escapeForFileName("test_ck_dataq_r77"))
+	assert.Equal(t, "n%2Ea", escapeForFileName("n.a"))
+	assert.Equal(t, "a%2Db%20c", escapeForFileName("a-b c"))
+}
+
+func TestCheckPart(t *testing.T) {
+	checksums := map[string]FileChecksum{
+		"count.txt":    {Size: 2, Hash: [16]byte{1}},
+		"primary.cidx": {Size: 48, Hash: [16]byte{2}},
+		"id.bin":       {Size: 200, Hash: [16]byte{3}},
+		"id.cmrk2":     {Size: 30, Hash: [16]byte{4}},
+		// replace_long_file_name_to_hash替换后的文件名
+		"e3b0c44298fc1c149afbf4c8996fb924.bin":   {Size: 150, Hash: [16]byte{5}},
+		"e3b0c44298fc1c149afbf4c8996fb924.cmrk2": {Size: 30, Hash: [16]byte{6}},
+	}
+	files := map[string]RemoteFile{
+		"checksums.txt": {Size: 50},
+		"columns.txt":   {Size: 50},
+	}
+	for name, c := range checksums {
+		files[name] = RemoteFile{Size: c.Size}
+	}
+	part := &PartInventory{Name: "20230731_1_1_0", PartType: "Wide", Rows: 10, Hash: hashOfAllFiles(checksums)[0]}
+	assert.Nil(t, checkPart(part, checksums, files))
+	// 不同版本的clickhouse高低64位的顺序不同
+	part.Hash = hashOfAllFiles(checksums)[1]
+	assert.Nil(t, checkPart(part, checksums, files))
+
+	files["id.bin"] = RemoteFile{Size: 10}
+	assert.NotNil(t, checkPart(part, checksums, files))
+	delete(files, "id.bin")
+	assert.NotNil(t, checkPart(part, checksums, files))
+	files["id.bin"] = RemoteFile{Size: 200}
+
+	// S3上的checksums.txt与clickhouse上的part不一致
+	c := checksums["id.bin"]
+	c.Hash[0] = 0xff
+	checksums["id.bin"] = c
+	assert.NotNil(t, checkPart(part, checksums, files))
+}
+
+// 按照clickhouse的格式生成checksums.txt
+func encodeChecksums(checksums map[string]FileChecksum) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(checksums)))
+	for name, c := range checksums {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, c.Size)
+		buf = append(buf, c.Hash[:]...)
+		// 压缩的文件还会记录压缩前的大小和hash
+		buf = append(buf, 1)
+		buf = binary.AppendUvarint(buf, c.Size*2)
+		buf = append(buf, make([]byte, 16)...)
+	}
+	return buf
+}
+
+func TestParseChecksums(t *testing.T) {
+	checksums := map[string]FileChecksum{
+		"count.txt": {Size: 2, Hash: [16]byte{1, 2, 3}},
+		"id.bin":    {Size: 300, Hash: [16]byte{4, 5, 6}},
+	}
+	data := encodeChecksums(checksums)
+	parsed, err := parseChecksums(append([]byte(CHECKSUMS_HEADER+"3\n"), data...))
+	assert.Nil(t, err)
+	assert.Equal(t, checksums, parsed)
+
+	w := compress.NewWriter()
+	assert.Nil(t, w.Compress(compress.LZ4, data))
+	parsed, err = parseChecksums(append([]byte(CHECKSUMS_HEADER+"4\n"), w.Data...))
+	assert.Nil(t, err)
+	assert.Equal(t, checksums, parsed)
+
+	_, err = parseChecksums([]byte(CHECKSUMS_HEADER + "2\n"))
+	assert.NotNil(t, err)
+
+	c := FileChecksum{Hash: [16]byte{1, 0, 0, 0, 0, 0, 0, 0, 2}}
+	assert.Equal(t, "00000000000000020000000000000001", c.Hex())
+}
+
+// SipHash-2-4的标准测试向量，key为00 01 02 ... 0f
+func TestSipHash(t *testing.T) {
+	sum64 := func(msg []byte) uint64 {
+		h := newSipHashKey(0x0706050403020100, 0x0f0e0d0c0b0a0908)
+		h.Write(msg)
+		h.finalize()
+		return h.v0 ^ h.v1 ^ h.v2 ^ h.v3
+	}
+	assert.Equal(t, uint64(0x726fdb47dd0e0e31), sum64(nil))
+	assert.Equal(t, uint64(0x74f839c593dc67fd), sum64([]byte{0}))
+
+	// 分多次写入与一次写入的结果一致
+	h1, h2 := newSipHash(), newSipHash()
+	h1.Write([]byte("checksums.txt"))
+	h2.Write([]byte("check"))
+	h2.Write([]byte("sums.txt"))
+	l1, r1 := h1.Sum128()
+	l2, r2 := h2.Sum128()
+	assert.Equal(t, l1, l2)
+	assert.Equal(t, r1, r2)
+}
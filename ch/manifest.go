@@ -0,0 +1,292 @@
+package ch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/layout"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const MANIFEST_NAME = layout.MANIFEST_NAME
+
+// 每张表每个分区备份成功后写入S3的清单，用于恢复和校验时比对
+type Manifest struct {
+	Database         string          `json:"database"`
+	Table            string          `json:"table"`
+	Partition        string          `json:"partition"`
+	Run              string          `json:"run,omitempty"`  //为空表示早期版本的路径
+	Base             string          `json:"base,omitempty"` //增量备份的base对应的manifest
+	Rows             uint64          `json:"rows"`
+	UncompressedSize uint64          `json:"uncompressed_size"`
+	CompressedSize   uint64          `json:"compressed_size"`
+	RemoteSize       uint64          `json:"remote_size"`
+	Shards           []ShardManifest `json:"shards"`
+	CompressMethod   string          `json:"compress_method"`
+	CompressLevel    int             `json:"compress_level"`
+	Version          string          `json:"version"`
+	Githash          string          `json:"githash"`
+	Timestamp        time.Time       `json:"timestamp"`
+}
+
+type ShardManifest struct {
+	Shard            int            `json:"shard"`
+	Host             string         `json:"host"`
+	Replicas         []string       `json:"replicas"`
+	Key              string         `json:"key"`
+	BaseKey          string         `json:"base_key,omitempty"`
+	ServerVersion    string         `json:"server_version"`
+	Rows             uint64         `json:"rows"`
+	UncompressedSize uint64         `json:"uncompressed_size"`
+	CompressedSize   uint64         `json:"compressed_size"`
+	RemoteSize       uint64         `json:"remote_size"`
+	Parts            []string       `json:"parts"`
+	Files            []FileManifest `json:"files"`
+}
+
+type FileManifest struct {
+	Name string `json:"name"` //相对于Key的路径
+	Size uint64 `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// S3上manifest的路径，默认为 partition/database.table/[run/]manifest.json
+func manifestKey(database, table, partition, run string) string {
+	return layout.ManifestKey(layout.Vars{Database: database, Table: table, Partition: partition, Run: run})
+}
+
+func (m *Manifest) Key() string {
+	return manifestKey(m.Database, m.Table, m.Partition, m.Run)
+}
+
+// 由每个分片的manifest汇总成分区的manifest，bases不为空时为增量备份
+func NewManifest(database, table, partition, run string, bases []*Manifest, shards []ShardManifest, conf config.S3) *Manifest {
+	m := &Manifest{
+		Database:       database,
+		Table:          table,
+		Partition:      partition,
+		Run:            run,
+		CompressMethod: conf.CompressMethod,
+		CompressLevel:  conf.CompressLevel,
+		Timestamp:      time.Now(),
+	}
+	if len(bases) > 0 {
+		m.Base = bases[0].Key()
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Shard < shards[j].Shard })
+	for _, shard := range shards {
+		m.Rows += shard.Rows
+		m.UncompressedSize += shard.UncompressedSize
+		m.CompressedSize += shard.CompressedSize
+		m.RemoteSize += shard.RemoteSize
+		m.Shards = append(m.Shards, shard)
+	}
+	return m
+}
+
+// 收集一个分片上该分区的行数，大小，part以及S3上的文件清单，需要在清理本地数据之前收集
+func shardManifest(ctx context.Context, conn Conn, shard int, database, table, partition, key string, bases []*Manifest, conf config.S3) (ShardManifest, error) {
+	stat, err := shardStat(ctx, conn, shard, database, table, partition)
+	if err != nil {
+		return ShardManifest{}, err
+	}
+	m := ShardManifest{
+		Shard:            shard,
+		Host:             conn.h,
+		Key:              key,
+		ServerVersion:    stat.ServerVersion,
+		Rows:             stat.Rows,
+		UncompressedSize: stat.UncompressedSize,
+		CompressedSize:   stat.CompressedSize,
+		Parts:            stat.Parts,
+	}
+	if len(bases) > 0 && shard < len(bases[0].Shards) {
+		m.BaseKey = bases[0].Shards[shard].Key
+	}
+	for _, replica := range conns[shard] {
+		m.Replicas = append(m.Replicas, replica.h)
+	}
+	err = s3client.Walk(ctx, conf.Bucket, key+"/", func(object *s3.Object) error {
+		m.Files = append(m.Files, FileManifest{
+			Name: strings.TrimPrefix(*object.Key, key+"/"),
+			Size: uint64(*object.Size),
+			ETag: strings.Trim(*object.ETag, "\""),
+		})
+		m.RemoteSize += uint64(*object.Size)
+		return nil
+	})
+	return m, err
+}
+
+func WriteManifest(ctx context.Context, m *Manifest, conf config.S3) error {
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := m.Key()
+	log.Logger.Infof("write manifest %s, rows: %d, remote size: %d", key, m.Rows, m.RemoteSize)
+	return s3client.PutObject(ctx, conf.Bucket, key, raw)
+}
+
+func ReadManifest(ctx context.Context, key string, conf config.S3) (*Manifest, error) {
+	raw, err := s3client.GetObject(ctx, conf.Bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// 读取指定run的manifest，不存在时返回nil
+func SnapshotManifest(ctx context.Context, database, table, partition, run string, conf config.S3) (*Manifest, error) {
+	m, err := ReadManifest(ctx, manifestKey(database, table, partition, run), conf)
+	if s3client.IsNotFound(err) {
+		return nil, nil
+	}
+	return m, err
+}
+
+// 该分区在S3上的所有run，从新到旧，最后一个为空表示早期版本的路径
+func runs(ctx context.Context, database, table, partition string, conf config.S3) ([]string, error) {
+	var runs []string
+	prefix := PartitionDir(database, table, partition)
+	err := s3client.WalkPrefixes(ctx, conf.Bucket, prefix, func(p string) error {
+		run := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if IsRun(run) {
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runs)))
+	return append(runs, ""), nil
+}
+
+// 该分区最新的一次成功备份的manifest，manifest只在所有分片都备份成功后写入，不存在时返回nil
+func LatestManifest(ctx context.Context, database, table, partition string, conf config.S3) (*Manifest, error) {
+	runs, err := runs(ctx, database, table, partition, conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		m, err := SnapshotManifest(ctx, database, table, partition, run, conf)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// 该分区所有成功备份的manifest，从新到旧
+func Manifests(ctx context.Context, database, table, partition string, conf config.S3) ([]*Manifest, error) {
+	runs, err := runs(ctx, database, table, partition, conf)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*Manifest
+	for _, run := range runs {
+		m, err := SnapshotManifest(ctx, database, table, partition, run, conf)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			manifests = append(manifests, m)
+		}
+	}
+	return manifests, nil
+}
+
+// 从m开始沿着base找到整条备份链，最后一个为全量备份，任何一个base不存在都返回错误
+func ManifestChain(ctx context.Context, m *Manifest, conf config.S3) ([]*Manifest, error) {
+	var chain []*Manifest
+	visited := make(map[string]struct{})
+	for m != nil {
+		if _, ok := visited[m.Key()]; ok {
+			return nil, fmt.Errorf("manifest %s has circular base", m.Key())
+		}
+		visited[m.Key()] = struct{}{}
+		chain = append(chain, m)
+		if m.Base == "" {
+			break
+		}
+		base, err := ReadManifest(ctx, m.Base, conf)
+		if err != nil {
+			return nil, fmt.Errorf("base %s of %s not found: %v", m.Base, m.Key(), err)
+		}
+		m = base
+	}
+	return chain, nil
+}
+
+// 一个分片上某个分区当前的统计信息
+type ShardStat struct {
+	Shard            int
+	Host             string
+	ServerVersion    string
+	Parts            []string
+	Rows             uint64
+	UncompressedSize uint64
+	CompressedSize   uint64
+}
+
+// 查询每个分片上该分区当前的part，行数以及大小
+func PartitionStats(ctx context.Context, database, table, partition string) ([]ShardStat, error) {
+	var stats []ShardStat
+	for i := range conns {
+		conn, err := GetAvaliableConn(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		stat, err := shardStat(ctx, conn, i, database, table, partition)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func shardStat(ctx context.Context, conn Conn, shard int, database, table, partition string) (ShardStat, error) {
+	query := fmt.Sprintf("SELECT name, rows, data_uncompressed_bytes, data_compressed_bytes FROM system.parts WHERE active AND database = '%s' AND table = '%s' AND partition = '%s' ORDER BY name",
+		database, table, partition)
+	stat := ShardStat{
+		Shard: shard,
+		Host:  conn.h,
+	}
+	if err := conn.c.QueryRow(ctx, "SELECT version()").Scan(&stat.ServerVersion); err != nil {
+		return stat, err
+	}
+	log.Logger.Debugf("[%s]%s", conn.h, query)
+	rows, err := conn.c.Query(ctx, query)
+	if err != nil {
+		return stat, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var cnt, bunc, bc uint64
+		if err = rows.Scan(&name, &cnt, &bunc, &bc); err != nil {
+			return stat, err
+		}
+		stat.Parts = append(stat.Parts, name)
+		stat.Rows += cnt
+		stat.UncompressedSize += bunc
+		stat.CompressedSize += bc
+	}
+	return stat, rows.Err()
+}
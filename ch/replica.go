@@ -0,0 +1,146 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/YenchangChan/ch2s3/log"
+)
+
+// 表引擎，从system.tables中查询
+func tableEngine(ctx context.Context, conn Conn, database, table string) (string, error) {
+	var engine string
+	query := fmt.Sprintf("SELECT engine FROM system.tables WHERE database = '%s' AND name = '%s'", database, table)
+	if err := conn.c.QueryRow(ctx, query).Scan(&engine); err != nil {
+		return "", fmt.Errorf("[%s]get engine of %s.%s failed: %v", conn.h, database, table, err)
+	}
+	return engine, nil
+}
+
+// Replicated*MergeTree表的数据会同步到同一个分片的其他副本，其他引擎的每个副本都需要单独处理
+func isReplicated(ctx context.Context, conn Conn, database, table string) (bool, error) {
+	engine, err := tableEngine(ctx, conn, database, table)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(engine, "Replicated"), nil
+}
+
+// 一个副本上该分区的active part的行数
+func replicaRows(ctx context.Context, conn Conn, database, table, partition string) (uint64, error) {
+	var rows uint64
+	query := fmt.Sprintf("SELECT sum(rows) FROM system.parts WHERE active AND database = '%s' AND table = '%s' AND partition = '%s'",
+		database, table, partition)
+	if err := conn.c.QueryRow(ctx, query).Scan(&rows); err != nil {
+		return 0, fmt.Errorf("[%s]query rows of %s.%s partition %s failed: %v", conn.h, database, table, partition, err)
+	}
+	return rows, nil
+}
+
+// 单个副本上分区压缩后的大小，用于估算备份的剩余时间
+func replicaBytes(ctx context.Context, conn Conn, database, table, partition string) (uint64, error) {
+	var size uint64
+	query := fmt.Sprintf("SELECT sum(data_compressed_bytes) FROM system.parts WHERE active AND database = '%s' AND table = '%s' AND partition = '%s'",
+		database, table, partition)
+	if err := conn.c.QueryRow(ctx, query).Scan(&size); err != nil {
+		return 0, fmt.Errorf("[%s]query size of %s.%s partition %s failed: %v", conn.h, database, table, partition, err)
+	}
+	return size, nil
+}
+
+// 确认指定分片的每个副本上都已经没有该分区的数据，shards为空时为所有分片
+func verifyDropped(ctx context.Context, database, table, partition string, shards []int) error {
+	var lastErr error
+	for i, shard := range conns {
+		if !inShards(shards, i) {
+			continue
+		}
+		for _, conn := range shard {
+			rows, err := replicaRows(ctx, conn, database, table, partition)
+			if err == nil && rows > 0 {
+				err = fmt.Errorf("[%s]partition %s of %s.%s still has %d rows on shard %d", conn.h, partition, database, table, rows, i+1)
+			}
+			if err != nil {
+				log.Logger.Errorf("%v", err)
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// 需要恢复数据的副本，Replicated表只需要一个可用的副本，其他引擎需要该分片的所有副本都可用
+func restoreTargets(ctx context.Context, shard int, database, table string) ([]Conn, error) {
+	conn, err := GetAvaliableConn(ctx, shard)
+	if err != nil {
+		return nil, err
+	}
+	replicated, err := isReplicated(ctx, conn, database, table)
+	if err != nil {
+		return nil, err
+	}
+	if replicated {
+		return []Conn{conn}, nil
+	}
+	for _, replica := range conns[shard] {
+		if err = replica.c.Ping(ctx); err != nil {
+			return nil, fmt.Errorf("[%s]%s.%s is not replicated, every replica must be available: %v", replica.h, database, table, err)
+		}
+	}
+	return conns[shard], nil
+}
+
+// 恢复完成后确认每个分片的所有副本上该分区的行数一致，Replicated表先等待副本同步完成
+func VerifyReplicas(ctx context.Context, database, table, partition string) error {
+	var lastErr error
+	for i, shard := range conns {
+		if len(shard) < 2 {
+			continue
+		}
+		conn, err := GetAvaliableConn(ctx, i)
+		if err != nil {
+			return err
+		}
+		replicated, err := isReplicated(ctx, conn, database, table)
+		if err != nil {
+			return err
+		}
+		var hosts []string
+		var counts []uint64
+		for _, replica := range shard {
+			if replicated {
+				query := fmt.Sprintf("SYSTEM SYNC REPLICA `%s`.`%s`", database, table)
+				log.Logger.Infof("execute sql => [%s]%s", replica.h, query)
+				if err = replica.c.Exec(ctx, query); err != nil {
+					return fmt.Errorf("[%s]sync replica failed: %v", replica.h, err)
+				}
+			}
+			rows, err := replicaRows(ctx, replica, database, table, partition)
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, replica.h)
+			counts = append(counts, rows)
+		}
+		mismatch := false
+		for j := range counts {
+			mismatch = mismatch || counts[j] != counts[0]
+		}
+		if mismatch {
+			lastErr = fmt.Errorf("partition %s of %s.%s rows mismatch between replicas of shard %d: %s", partition, database, table, i+1, replicaCounts(hosts, counts))
+			log.Logger.Errorf("%v", lastErr)
+		} else {
+			log.Logger.Infof("partition %s of %s.%s rows match between replicas of shard %d: %s", partition, database, table, i+1, replicaCounts(hosts, counts))
+		}
+	}
+	return lastErr
+}
+
+func replicaCounts(hosts []string, counts []uint64) string {
+	var s []string
+	for i := range hosts {
+		s = append(s, fmt.Sprintf("%s=%d", hosts[i], counts[i]))
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,150 @@
+package ch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/avast/retry-go/v4"
+)
+
+// 重新分片恢复，备份时的分片数与当前集群不一致时使用
+type Reshard struct {
+	Distributed string //已有的指向目标表的Distributed表，格式为database.table
+	ShardingKey string //不指定Distributed时，按照该分片键创建临时的Distributed表
+	Cluster     string
+}
+
+// 一个源分片的恢复进度
+type ShardProgress struct {
+	Shard   int //备份时的分片编号，从1开始
+	Host    string
+	Key     string
+	Rows    uint64
+	Elapsed time.Duration
+	Err     error
+}
+
+// 重新分片恢复一个分区：每个源分片的备份先恢复到某个节点上的临时表中，再通过Distributed表按照分片键写入目标表，最后删除临时表
+// keys[i]为第i个源分片的备份链，hosts[i]为备份时使用的host，仅用于展示，run用于生成临时表的名称
+func ReshardRestore(ctx context.Context, database, table, tdatabase, ttable, partition, run string, keys [][]string, hosts []string,
+	opts Reshard, conf config.S3, progress func(ShardProgress)) error {
+	conn, err := GetAvaliableConn(ctx, 0)
+	if err != nil {
+		return err
+	}
+	staging := fmt.Sprintf("_ch2s3_staging_%s_%s", ttable, run)
+	dist := opts.Distributed
+	if dist == "" {
+		if opts.Cluster == "" || opts.ShardingKey == "" {
+			return fmt.Errorf("reshard restore requires a distributed table, or cluster and sharding key")
+		}
+		name := fmt.Sprintf("_ch2s3_dist_%s_%s", ttable, run)
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` AS `%s`.`%s` ENGINE = Distributed('%s', '%s', '%s', %s)",
+			tdatabase, name, tdatabase, ttable, opts.Cluster, tdatabase, ttable, opts.ShardingKey)
+		log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+		if err = conn.c.Exec(ctx, query); err != nil {
+			return err
+		}
+		defer dropTable(conn, tdatabase, name)
+		dist = fmt.Sprintf("`%s`.`%s`", tdatabase, name)
+	}
+
+	var lastErr error
+	var done []int
+	for i := range keys {
+		if len(keys[i]) == 0 {
+			continue
+		}
+		p := ShardProgress{Shard: i + 1, Key: keys[i][0]}
+		if i < len(hosts) {
+			p.Host = hosts[i]
+		}
+		start := time.Now()
+		p.Rows, p.Err = restoreStaging(ctx, conn, database, table, tdatabase, staging, partition, keys[i], dist, conf)
+		p.Elapsed = time.Since(start)
+		if p.Err != nil {
+			log.Logger.Errorf("[%s]reshard restore %s shard %d failed: %v", conn.h, partition, p.Shard, p.Err)
+			// 已经写入目标表的数据不会回滚，失败的源分片也可能已经写入了一部分
+			lastErr = fmt.Errorf("reshard restore shard %d failed, rows of shards %v and part of shard %d may remain in %s.%s, drop partition %s and restore again: %v",
+				p.Shard, done, p.Shard, tdatabase, ttable, partition, p.Err)
+		} else {
+			log.Logger.Infof("[%s]reshard restore %s shard %d done, rows: %d, elapsed: %v", conn.h, partition, p.Shard, p.Rows, p.Elapsed)
+			done = append(done, p.Shard)
+		}
+		progress(p)
+		if lastErr != nil {
+			// 继续写入其他分片会使失败的分区更难清理
+			break
+		}
+	}
+	return lastErr
+}
+
+// 将一个源分片的备份恢复到临时表，再写入Distributed表，返回写入的行数
+func restoreStaging(ctx context.Context, conn Conn, database, table, tdatabase, staging, partition string, keys []string, dist string, conf config.S3) (uint64, error) {
+	schema, err := backupSchema(ctx, keys, database, table, conf)
+	if err != nil {
+		return 0, err
+	}
+	// 临时表不需要副本，保留Replicated引擎会在ZooKeeper上注册副本，ZooKeeper路径中没有{table}时还会与原表冲突
+	query, err := renameCreateQuery(stripReplication(schema), database, table, tdatabase, staging)
+	if err != nil {
+		return 0, err
+	}
+	log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+	if err = conn.c.Exec(ctx, query); err != nil {
+		return 0, err
+	}
+	defer dropTable(conn, tdatabase, staging)
+
+	var base string
+	if len(keys) > 1 {
+		base = keys[1]
+	}
+	query = genResoreSql(database, table, tdatabase, staging, partition, keys[0], base, conf)
+	if err = retry.Do(
+		func() error {
+			err := execAsync(ctx, conn, "restore", fmt.Sprintf("%s.%s/%s", tdatabase, staging, keys[0]), query, 0)
+			var exception *clickhouse.Exception
+			if errors.As(err, &exception) && exception.Code == 599 {
+				return fmt.Errorf("backup %s not found: %v", keys[0], err)
+			}
+			return err
+		},
+		retry.LastErrorOnly(true),
+		retry.Context(ctx),
+		retry.Attempts(conf.RetryTimes),
+		retry.Delay(10*time.Second),
+	); err != nil {
+		return 0, err
+	}
+
+	var rows uint64
+	query = fmt.Sprintf("SELECT count() FROM `%s`.`%s`", tdatabase, staging)
+	if err = conn.c.QueryRow(ctx, query).Scan(&rows); err != nil {
+		return 0, err
+	}
+	// 同步写入每个分片，INSERT返回时数据已经写入目标表
+	sctx := clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_distributed_sync": 1,
+	}))
+	query = fmt.Sprintf("INSERT INTO %s SELECT * FROM `%s`.`%s`", dist, tdatabase, staging)
+	log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+	if err = conn.c.Exec(sctx, query); err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+func dropTable(conn Conn, database, table string) {
+	query := fmt.Sprintf("DROP TABLE IF EXISTS `%s`.`%s` SYNC", database, table)
+	log.Logger.Infof("execute sql => [%s]%s", conn.h, query)
+	if err := conn.c.Exec(context.Background(), query); err != nil {
+		log.Logger.Errorf("[%s]drop table %s.%s failed: %v", conn.h, database, table, err)
+	}
+}
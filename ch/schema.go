@@ -0,0 +1,122 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+)
+
+var (
+	createTableRe = regexp.MustCompile("(?is)^\\s*(?:CREATE|ATTACH)\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(?:`[^`]+`|\\w+)(?:\\.(?:`[^`]+`|\\w+))?(?:\\s+UUID\\s+'[^']*')?")
+	replicatedRe  = regexp.MustCompile(`(?i)ENGINE\s*=\s*Replicated\w*MergeTree\s*\(\s*'([^']*)'`)
+)
+
+// BACKUP时clickhouse保存的建表语句在备份中的路径
+func metadataKey(key, database, table string) string {
+	return fmt.Sprintf("%s/metadata/%s/%s.sql", key, escapeForFileName(database), escapeForFileName(table))
+}
+
+// 将备份中的建表语句改为创建目标表，去掉原表的UUID
+// Replicated表的zookeeper路径中如果写死了原表的库名和表名，替换为目标表的，避免与原表共用同一个路径
+func renameCreateQuery(query, database, table, tdatabase, ttable string) (string, error) {
+	loc := createTableRe.FindStringIndex(query)
+	if loc == nil {
+		return "", fmt.Errorf("unexpected create query of %s.%s: %s", database, table, query)
+	}
+	query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s`", tdatabase, ttable) + query[loc[1]:]
+	m := replicatedRe.FindStringSubmatchIndex(query)
+	if m == nil {
+		return query, nil
+	}
+	zkpath := query[m[2]:m[3]]
+	if strings.Contains(zkpath, "{uuid}") || (strings.Contains(zkpath, "{database}") && strings.Contains(zkpath, "{table}")) {
+		return query, nil
+	}
+	segments := strings.Split(zkpath, "/")
+	changed := false
+	for i, s := range segments {
+		switch s {
+		case database:
+			segments[i] = tdatabase
+		case table:
+			segments[i] = ttable
+		case database + "." + table:
+			segments[i] = tdatabase + "." + ttable
+		default:
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return "", fmt.Errorf("zookeeper path %s of %s.%s does not contain the table name, please create %s.%s manually", zkpath, database, table, tdatabase, ttable)
+	}
+	return query[:m[2]] + strings.Join(segments, "/") + query[m[3]:], nil
+}
+
+func tableExists(ctx context.Context, conn Conn, database, table string) (bool, error) {
+	var cnt uint64
+	query := fmt.Sprintf("SELECT count() FROM system.tables WHERE database = '%s' AND name = '%s'", database, table)
+	if err := conn.c.QueryRow(ctx, query).Scan(&cnt); err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// 从备份中读取建表语句，keys为该分片的备份链，增量备份中未变化的文件保存在base中
+func backupSchema(ctx context.Context, keys []string, database, table string, conf config.S3) (string, error) {
+	for _, key := range keys {
+		raw, err := s3client.GetObject(ctx, conf.Bucket, metadataKey(key, database, table))
+		if s3client.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(raw), nil
+	}
+	return "", fmt.Errorf("schema of %s.%s not found in backup %v", database, table, keys)
+}
+
+// 恢复到其他表时，在每个分片的所有副本上按照备份中的表结构创建目标表，已经存在的不做处理
+// 需要恢复的分片有副本无法连接时返回错误，否则该副本上没有目标表，恢复后查询该副本会失败
+func CreateRestoreTable(ctx context.Context, database, table, tdatabase, ttable string, keys [][]string, conf config.S3) error {
+	for i, shard := range conns {
+		if i >= len(keys) || len(keys[i]) == 0 {
+			continue
+		}
+		var query string
+		for _, conn := range shard {
+			if err := conn.c.Ping(ctx); err != nil {
+				return fmt.Errorf("[%s]ping failed, can not create %s.%s on shard %d: %v", conn.h, tdatabase, ttable, i+1, err)
+			}
+			exists, err := tableExists(ctx, conn, tdatabase, ttable)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if query == "" {
+				schema, err := backupSchema(ctx, keys[i], database, table, conf)
+				if err != nil {
+					return err
+				}
+				if query, err = renameCreateQuery(schema, database, table, tdatabase, ttable); err != nil {
+					return err
+				}
+			}
+			for _, sql := range []string{fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", tdatabase), query} {
+				log.Logger.Infof("execute sql => [%s]%s", conn.h, sql)
+				if err = conn.c.Exec(ctx, sql); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
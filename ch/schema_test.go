@@ -0,0 +1,32 @@
+package ch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameCreateQuery(t *testing.T) {
+	query := "CREATE TABLE default.events UUID 'c3a3c6e1-6d0a-4f5e-9c6a-1f0e2b3c4d5e' (`id` UInt64, `ts` DateTime) ENGINE = MergeTree PARTITION BY toYYYYMMDD(ts) ORDER BY id"
+	sql, err := renameCreateQuery(query, "default", "events", "scratch", "events_restored")
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS `scratch`.`events_restored` (`id` UInt64, `ts` DateTime) ENGINE = MergeTree PARTITION BY toYYYYMMDD(ts) ORDER BY id", sql)
+
+	query = "CREATE TABLE `default`.`events` (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/default/events', '{replica}') ORDER BY id"
+	sql, err = renameCreateQuery(query, "default", "events", "scratch", "events_restored")
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS `scratch`.`events_restored` (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/scratch/events_restored', '{replica}') ORDER BY id", sql)
+
+	query = "CREATE TABLE default.events (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id"
+	sql, err = renameCreateQuery(query, "default", "events", "scratch", "events_restored")
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS `scratch`.`events_restored` (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id", sql)
+
+	// zookeeper路径与表名无关时无法安全改写
+	query = "CREATE TABLE default.events (`id` UInt64) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/t1', '{replica}') ORDER BY id"
+	_, err = renameCreateQuery(query, "default", "events", "scratch", "events_restored")
+	assert.NotNil(t, err)
+
+	_, err = renameCreateQuery("SELECT 1", "default", "events", "scratch", "events_restored")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,54 @@
+package ch
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/layout"
+)
+
+// 每次运行的ID，每次备份都保存在 partition/database.table/run/host 下，重复备份同一个分区不会覆盖之前的备份
+const RUN_FORMAT = "20060102T150405"
+
+func NewRun() string {
+	return time.Now().Format(RUN_FORMAT)
+}
+
+func IsRun(s string) bool {
+	_, err := time.Parse(RUN_FORMAT, s)
+	return err == nil
+}
+
+// 一个分片的一次备份在S3上的路径，由配置的路径模板决定，shard从0开始
+// 默认为 partition/database.table/[run/]host，run为空时为早期版本的路径
+func snapshotKey(database, table, partition, run string, shard int, host string) string {
+	return layout.Key(layout.Vars{
+		Database:  database,
+		Table:     table,
+		Partition: partition,
+		Run:       run,
+		Host:      host,
+		Shard:     shard + 1,
+	})
+}
+
+// 分区目录，包含该分区所有的备份，以"/"结尾
+func PartitionDir(database, table, partition string) string {
+	return layout.Dir(layout.Vars{Database: database, Table: table, Partition: partition}) + "/"
+}
+
+// 某个分片在备份链上的所有路径，从最新的备份到最早的全量备份
+// chain为空说明没有manifest，只能按照当前的host查找早期版本的备份
+func chainKeys(chain []*Manifest, shard int, database, table, partition, host string) ([]string, error) {
+	if len(chain) == 0 {
+		return []string{snapshotKey(database, table, partition, "", shard, host)}, nil
+	}
+	var keys []string
+	for _, m := range chain {
+		if shard >= len(m.Shards) {
+			return nil, fmt.Errorf("shard %d not found in manifest %s", shard, m.Key())
+		}
+		keys = append(keys, m.Shards[shard].Key)
+	}
+	return keys, nil
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -19,13 +23,28 @@ type CmdOptions struct {
 	Region     string `short:"r" long:"region" description:"AWS region"`
 	EndPoint   string `short:"e" long:"endpoint" description:"S3 endpoint"`
 	DryRun     bool   `short:"d" long:"dryrun" description:"Dry run mode"`
+	ETag       bool   `short:"t" long:"etag" description:"Print md5 and s3 etag of files instead of upload"`
+	PartSize   int64  `long:"part-size" default:"16777216" description:"Multipart upload part size, used by --etag"`
+	SinglePart int64  `long:"single-part-size" default:"33554432" description:"Max single part upload size, used by --etag"`
+	Factor     int64  `long:"multiply-factor" default:"2" description:"Part size multiply factor, used by --etag"`
+	Threshold  int    `long:"multiply-threshold" default:"500" description:"Multiply part size every threshold parts, used by --etag"`
 }
 
 // ./s3uploader -b 19700101/default.test_ck_dataq_r30/192.168.101.93/data/default/test_ck_dataq_r30/19700101_0_0_0 -f /data01/clickhouse/store/3cc/3ccf8474-fa31-469f-8ace-26ece20686d6/19700101_0_0_0 -a VdmPbwvMlH8ryeqW -s 8z16tUktXpvcjjy5M4MqXvCks5MMHb63 -r zh-west-1 -e http://192.168.101.94:49000/backup
+// ./s3uploader -t -f /data01/clickhouse/store/3cc/3ccf8474-fa31-469f-8ace-26ece20686d6/19700101_0_0_0/
 func main() {
-	log.InitLogger("info", []string{"stdout"})
 	var opts CmdOptions
 	flags.Parse(&opts)
+	if opts.ETag {
+		// 输出由ch2s3解析，不能打印日志
+		log.InitLogger("fatal", []string{"stderr"})
+		if err := printETags(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	log.InitLogger("info", []string{"stdout"})
 	conf := config.S3{
 		Endpoint:       opts.EndPoint,
 		CompressMethod: "lz4",
@@ -36,6 +55,7 @@ func main() {
 		RetryTimes:     1,
 		UsePathStyle:   true,
 		CleanIfFail:    true,
+		DeleteWorkers:  8,
 	}
 
 	raw, err := json.MarshalIndent(opts, "  ", "  ")
@@ -56,10 +76,10 @@ func main() {
 	for _, file := range files {
 		go func(file string) {
 			defer wg.Done()
-			err = s3client.Upload(conf.Bucket, file, opts.BucketName, opts.DryRun)
+			err = s3client.Upload(context.Background(), conf.Bucket, file, opts.BucketName, opts.DryRun)
 			if err != nil {
 				if conf.CleanIfFail {
-					s3client.Remove(conf.Bucket, opts.BucketName)
+					s3client.Remove(context.Background(), conf.Bucket, opts.BucketName, conf.DeleteWorkers)
 				}
 				lastErr = err
 				return
@@ -73,3 +93,33 @@ func main() {
 	}
 	log.Logger.Infoln("Upload success")
 }
+
+// 按照 "md5 etag path" 的格式输出每个文件的MD5和上传到S3后的ETag
+func printETags(opts CmdOptions) error {
+	conf := config.S3{
+		PartSize:              opts.PartSize,
+		SinglePartSize:        opts.SinglePart,
+		PartMultiplyFactor:    opts.Factor,
+		PartMultiplyThreshold: opts.Threshold,
+	}
+	for _, folder := range strings.Split(opts.FolderPath, ",") {
+		err := filepath.Walk(folder, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			md5sum, etag, err := s3client.FileETag(fpath, conf)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s %s\n", md5sum, etag, fpath)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YenchangChan/ch2s3/backup"
+	"github.com/YenchangChan/ch2s3/ch"
+	"github.com/YenchangChan/ch2s3/constant"
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/YenchangChan/ch2s3/s3client"
+)
+
+type command struct {
+	name  string
+	short string
+	long  string
+	data  interface{}
+}
+
+var commands = []command{
+	{"backup", "Backup partitions to s3",
+		"Backup the partitions of the configured tables to s3. Backup today's partition if neither --partition nor --ttl is given.",
+		&BackupCmd{}},
+	{"restore", "Restore partitions from s3",
+		"Restore the partitions of the configured tables from s3 into the original tables.",
+		&RestoreCmd{}},
+	{"list", "List backups on s3",
+		"Walk the bucket and list all backups on s3, grouped by partition, table and host.",
+		&ListCmd{}},
+	{"verify", "Verify backups on s3 against local data",
+		"Verify that the backups on s3 match the local parts of the configured tables, without backup anything.",
+		&VerifyCmd{}},
+	{"delete", "Delete backups of the given partitions from s3",
+		"Delete the backups of the given partitions of the configured tables from s3.",
+		&DeleteCmd{}},
+	{"prune", "Delete expired backups from s3",
+		"Delete the expired backups of the configured tables from s3 according to the retention policy in config, or older than --ttl.",
+		&PruneCmd{}},
+	{"status", "Show the latest reporter",
+		"Show the reporter of the latest run.",
+		&StatusCmd{}},
+	{"check", "Check clickhouse, ssh and s3 connectivity",
+		"Check that every replica is reachable by clickhouse and ssh, the configured tables exist and the s3 bucket is accessible.",
+		&CheckCmd{}},
+}
+
+type BackupCmd struct {
+	Partition string `short:"p" long:"partition" description:"partitions to backup, separated by comma, default today"`
+	TTL       string `long:"ttl" description:"backup all partitions older than ttl, such as '7 DAY', '3 MONTH', '1 YEAR'"`
+	Resume    string `long:"resume" description:"resume the interrupted run, such as '20230801T020000', skip the partitions already done and use the partitions of that run"`
+}
+
+func (cmd *BackupCmd) Execute(args []string) error {
+	if cmd.Resume != "" && (cmd.Partition != "" || cmd.TTL != "") {
+		return fmt.Errorf("--resume can not be used with --partition or --ttl, the partitions of the resumed run are used")
+	}
+	if cmd.Resume != "" && !ch.IsRun(cmd.Resume) {
+		return fmt.Errorf("invalid run %s, expect format %s", cmd.Resume, ch.RUN_FORMAT)
+	}
+	partition, cponly, err := resolvePartition(cmd.Partition, cmd.TTL)
+	if err != nil {
+		return err
+	}
+	conf, err := setup(constant.OP_TYPE_BACKUP)
+	if err != nil {
+		return err
+	}
+	back := backup.NewBack(conf, constant.OP_TYPE_BACKUP, partition, cwd, cponly)
+	if cmd.Resume != "" {
+		if err = back.Resume(cmd.Resume); err != nil {
+			return err
+		}
+	}
+	return run(back, constant.OP_TYPE_BACKUP, back.Do)
+}
+
+type RestoreCmd struct {
+	Partition   string `short:"p" long:"partition" description:"partitions to restore, separated by comma"`
+	From        string `long:"from" description:"restore partitions backed up on s3 since this one, such as '20230101' or '3 MONTH'"`
+	To          string `long:"to" description:"restore partitions backed up on s3 until this one, such as '20230331' or '1 MONTH'"`
+	Snapshot    string `short:"s" long:"snapshot" description:"restore the backup of this run, such as '20230801T020000', default the latest complete one"`
+	Table       string `short:"t" long:"table" description:"only restore this table, default all configured tables"`
+	AsDatabase  string `long:"as-database" description:"restore into this database instead of the original one, the target table is created from the backup if not exists"`
+	AsTable     string `long:"as-table" description:"restore into this table instead of the original one, only one table can be restored"`
+	Reshard     bool   `long:"reshard" description:"restore to a cluster with a different number of shards, each shard of the backup is restored into a staging table and redistributed by a distributed table"`
+	Distributed string `long:"distributed" description:"with --reshard, the existing distributed table of the target table, such as 'default.events_all'"`
+	ShardingKey string `long:"sharding-key" description:"with --reshard, the sharding key of the temporary distributed table, required if --distributed is not given"`
+	Atomic      bool   `long:"atomic" description:"restore into a shadow table first, verify rows, then replace the partition of the target table atomically on each shard"`
+	Force       bool   `long:"force" description:"restore even if the partition of the target table is not empty, replace it with --atomic, otherwise append to it"`
+}
+
+func (cmd *RestoreCmd) Execute(args []string) error {
+	if cmd.Partition != "" && (cmd.From != "" || cmd.To != "") {
+		return fmt.Errorf("--partition and --from/--to can not be used together")
+	}
+	if cmd.Partition == "" && cmd.From == "" && cmd.To == "" {
+		return fmt.Errorf("one of --partition, --from or --to must be specified")
+	}
+	if cmd.Snapshot != "" && !ch.IsRun(cmd.Snapshot) {
+		return fmt.Errorf("invalid snapshot %s, expect format %s", cmd.Snapshot, ch.RUN_FORMAT)
+	}
+	if cmd.Atomic && cmd.Reshard {
+		return fmt.Errorf("--atomic and --reshard can not be used together")
+	}
+	from, err := parseBound(cmd.From)
+	if err != nil {
+		return err
+	}
+	to, err := parseBound(cmd.To)
+	if err != nil {
+		return err
+	}
+	conf, err := setup(constant.OP_TYPE_RESTORE)
+	if err != nil {
+		return err
+	}
+	if cmd.Table != "" {
+		found := false
+		for _, t := range conf.ClickHouse.Tables {
+			found = found || t == cmd.Table
+		}
+		if !found {
+			return fmt.Errorf("table %s is not in config", cmd.Table)
+		}
+		conf.ClickHouse.Tables = []string{cmd.Table}
+	}
+	if cmd.AsTable != "" && len(conf.ClickHouse.Tables) != 1 {
+		return fmt.Errorf("--as-table can only be used with one table, use --table to specify it")
+	}
+	if cmd.AsDatabase != "" || cmd.AsTable != "" {
+		// 命令行指定的目标表覆盖配置文件中的restore_as
+		restoreAs := make(map[string]string)
+		for _, t := range conf.ClickHouse.Tables {
+			database, table := conf.ClickHouse.RestoreTarget(t)
+			if cmd.AsDatabase != "" {
+				database = cmd.AsDatabase
+			}
+			if cmd.AsTable != "" {
+				table = cmd.AsTable
+			}
+			restoreAs[t] = database + "." + table
+		}
+		conf.ClickHouse.RestoreAs = restoreAs
+	}
+	var back *backup.Backup
+	if cmd.Partition != "" {
+		back = backup.NewBack(conf, constant.OP_TYPE_RESTORE, cmd.Partition, cwd, true)
+	} else {
+		back = backup.NewBack(conf, constant.OP_TYPE_RESTORE, to, cwd, false)
+		back.SetSince(from)
+	}
+	back.SetSnapshot(cmd.Snapshot)
+	back.SetRestoreMode(cmd.Atomic, cmd.Force)
+	if cmd.Reshard {
+		if cmd.Distributed == "" {
+			// 分片键决定数据在新集群上的分布，不提供默认值
+			if cmd.ShardingKey == "" {
+				return fmt.Errorf("--reshard requires --distributed or --sharding-key")
+			}
+			if conf.ClickHouse.Cluster == "" {
+				return fmt.Errorf("--reshard with --sharding-key requires cluster in config")
+			}
+		}
+		back.SetReshard(&ch.Reshard{
+			Distributed: cmd.Distributed,
+			ShardingKey: cmd.ShardingKey,
+			Cluster:     conf.ClickHouse.Cluster,
+		})
+	}
+	return run(back, constant.OP_TYPE_RESTORE, back.Restore)
+}
+
+type ListCmd struct {
+	Database  string `short:"d" long:"database" description:"only list backups of this database"`
+	Table     string `short:"t" long:"table" description:"only list backups of this table"`
+	Partition string `short:"p" long:"partition" description:"only list these partitions, separated by comma"`
+	From      string `long:"from" description:"only list partitions greater than or equal to this one"`
+	To        string `long:"to" description:"only list partitions less than or equal to this one"`
+	Format    string `short:"f" long:"format" choice:"table" choice:"json" choice:"csv" default:"table" description:"output format"`
+}
+
+func (cmd *ListCmd) Execute(args []string) error {
+	// 输出可能会被其他程序解析，日志不能打印到stdout
+	conf, err := setup("list", "stderr", "ch2s3.log")
+	if err != nil {
+		return err
+	}
+	if err = s3client.NewSession(&conf.S3Disk); err != nil {
+		return err
+	}
+	filter := backup.CatalogFilter{
+		Database: cmd.Database,
+		Table:    cmd.Table,
+		From:     cmd.From,
+		To:       cmd.To,
+	}
+	if cmd.Partition != "" {
+		filter.Partitions = strings.Split(cmd.Partition, ",")
+	}
+	catalog, err := backup.Catalog(context.Background(), conf.S3Disk.Bucket, filter)
+	if err != nil {
+		return err
+	}
+	return backup.WriteCatalog(os.Stdout, catalog, cmd.Format)
+}
+
+type VerifyCmd struct {
+	Partition string `short:"p" long:"partition" description:"partitions to verify, separated by comma, default today"`
+	TTL       string `long:"ttl" description:"verify all partitions older than ttl, such as '7 DAY', '3 MONTH', '1 YEAR'"`
+	Mode      string `short:"m" long:"mode" choice:"local" choice:"backup" choice:"parts" description:"local: compare with local files over ssh, backup: check against the .backup file written by clickhouse, parts: check against system.parts of clickhouse, default verify_mode in config"`
+	Deep      bool   `long:"deep" description:"in backup mode, download files and check the checksums recorded by clickhouse"`
+}
+
+func (cmd *VerifyCmd) Execute(args []string) error {
+	partition, cponly, err := resolvePartition(cmd.Partition, cmd.TTL)
+	if err != nil {
+		return err
+	}
+	conf, err := setup(constant.OP_TYPE_VERIFY)
+	if err != nil {
+		return err
+	}
+	if cmd.Mode != "" {
+		conf.S3Disk.VerifyMode = cmd.Mode
+	}
+	if cmd.Deep {
+		conf.S3Disk.CheckSum = true
+	}
+	back := backup.NewBack(conf, constant.OP_TYPE_VERIFY, partition, cwd, cponly)
+	return run(back, constant.OP_TYPE_VERIFY, back.Verify)
+}
+
+type DeleteCmd struct {
+	Partition string `short:"p" long:"partition" required:"true" description:"partitions to delete, separated by comma"`
+	Snapshot  string `short:"s" long:"snapshot" description:"only delete the backup of this run, such as '20230801T020000', default all backups of the partitions"`
+	DryRun    bool   `long:"dry-run" description:"only print what would be deleted"`
+}
+
+func (cmd *DeleteCmd) Execute(args []string) error {
+	if cmd.Snapshot != "" && !ch.IsRun(cmd.Snapshot) {
+		return fmt.Errorf("invalid snapshot %s, expect format %s", cmd.Snapshot, ch.RUN_FORMAT)
+	}
+	conf, err := setup(constant.OP_TYPE_DELETE)
+	if err != nil {
+		return err
+	}
+	back := backup.NewBack(conf, constant.OP_TYPE_DELETE, cmd.Partition, cwd, true)
+	back.SetSnapshot(cmd.Snapshot)
+	return run(back, constant.OP_TYPE_DELETE, func() error {
+		return back.Delete(cmd.DryRun)
+	})
+}
+
+type PruneCmd struct {
+	TTL    string `long:"ttl" description:"ignore retention policy, delete backups of all partitions older than ttl, such as '7 DAY', '3 MONTH', '1 YEAR'"`
+	DryRun bool   `long:"dry-run" description:"only print the plan of what would be deleted"`
+}
+
+func (cmd *PruneCmd) Execute(args []string) error {
+	var partition string
+	var err error
+	if cmd.TTL != "" {
+		if partition, err = parseTTL(cmd.TTL); err != nil {
+			return err
+		}
+	}
+	conf, err := setup(constant.OP_TYPE_PRUNE)
+	if err != nil {
+		return err
+	}
+	back := backup.NewBack(conf, constant.OP_TYPE_PRUNE, partition, cwd, false)
+	return run(back, constant.OP_TYPE_PRUNE, func() error {
+		if cmd.TTL != "" {
+			return back.Delete(cmd.DryRun)
+		}
+		return back.Prune(cmd.DryRun)
+	})
+}
+
+type StatusCmd struct {
+	All bool `short:"a" long:"all" description:"list all reporters instead of showing the latest one"`
+}
+
+func (cmd *StatusCmd) Execute(args []string) error {
+	files, err := filepath.Glob(path.Join(cwd, "reporter", "*.out"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Println("no reporter found")
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		fi, _ := os.Stat(files[i])
+		fj, _ := os.Stat(files[j])
+		return fi.ModTime().Before(fj.ModTime())
+	})
+	if cmd.All {
+		for _, f := range files {
+			fmt.Println(f)
+		}
+		return nil
+	}
+	raw, err := os.ReadFile(files[len(files)-1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n\n%s", files[len(files)-1], string(raw))
+	return nil
+}
+
+type CheckCmd struct{}
+
+func (cmd *CheckCmd) Execute(args []string) error {
+	conf, err := setup("check")
+	if err != nil {
+		return err
+	}
+	back := backup.NewBack(conf, "check", "", cwd, true)
+	if err = back.Init(); err != nil {
+		return err
+	}
+	defer back.Stop()
+	if err = back.Check(); err != nil {
+		return err
+	}
+	log.Logger.Infof("check success!")
+	return nil
+}
+
+// 根据-p和--ttl计算需要处理的分区，返回值cponly表示是否只处理指定的分区
+func resolvePartition(partition, ttl string) (string, bool, error) {
+	if partition != "" && ttl != "" {
+		return "", false, fmt.Errorf("--partition and --ttl can not be used together")
+	}
+	if ttl != "" {
+		p, err := parseTTL(ttl)
+		return p, false, err
+	}
+	if partition == "" {
+		partition = time.Now().Format("20060102")
+	}
+	return partition, true, nil
+}
+
+// 指定TTL时，默认按照toYYYYMMDD分区, 如"7 DAY"
+func parseTTL(ttl string) (string, error) {
+	ttlExpr := strings.Fields(ttl)
+	if len(ttlExpr) != 2 {
+		return "", fmt.Errorf("invalid ttl %q, expect like '7 DAY'", ttl)
+	}
+	interval, err := strconv.Atoi(ttlExpr[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid ttl %q: %v", ttl, err)
+	}
+	var year, month, day int
+	switch strings.ToUpper(ttlExpr[1]) {
+	case "DAY", "D":
+		day = interval * (-1)
+	case "WEEK", "W":
+		day = interval * 7 * (-1)
+	case "MONTH", "M", "MON":
+		month = interval * (-1)
+	case "YEAR", "Y":
+		year = interval * (-1)
+	default:
+		return "", fmt.Errorf("invalid ttl unit %q, expect DAY, WEEK, MONTH or YEAR", ttlExpr[1])
+	}
+	return time.Now().AddDate(year, month, day).Format("20060102"), nil
+}
+
+// 分区边界，可以是具体的分区，也可以是ttl表达式，如"3 MONTH"
+func parseBound(bound string) (string, error) {
+	if strings.Contains(strings.TrimSpace(bound), " ") {
+		return parseTTL(bound)
+	}
+	return strings.TrimSpace(bound), nil
+}
@@ -2,25 +2,38 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
+
+	"github.com/YenchangChan/ch2s3/constant"
 )
 
 type S3 struct {
-	Endpoint       string
-	Bucket         string `json:"-"`
-	Region         string
-	AccessKey      string
-	SecretKey      string
-	CompressMethod string `json:"compress_method"` //lz4, lz4hc, zstd,deflate_qpl
-	CompressLevel  int    `json:"compress_level"`
-	RetryTimes     uint   `json:"retry_times"`
-	CleanIfFail    bool
-	UsePathStyle   bool `json:"use_path_style"`
-	CheckSum       bool
-	CheckCnt       bool `json:"check_count"`
-	Upload         bool //使用原生的s3命令上传
+	Endpoint              string
+	Bucket                string `json:"-"`
+	Region                string
+	AccessKey             string
+	SecretKey             string
+	CompressMethod        string `json:"compress_method"` //lz4, lz4hc, zstd,deflate_qpl
+	CompressLevel         int    `json:"compress_level"`
+	RetryTimes            uint   `json:"retry_times"`
+	CleanIfFail           bool
+	UsePathStyle          bool `json:"use_path_style"`
+	CheckSum              bool
+	ChecksumMode          string `json:"checksum_mode"`                //etag, download
+	PartSize              int64  `json:"multipart_part_size"`          //对应clickhouse的s3_min_upload_part_size
+	SinglePartSize        int64  `json:"multipart_threshold"`          //对应clickhouse的s3_max_single_part_upload_size
+	PartMultiplyFactor    int64  `json:"multipart_multiply_factor"`    //对应clickhouse的s3_upload_part_size_multiply_factor
+	PartMultiplyThreshold int    `json:"multipart_multiply_threshold"` //对应clickhouse的s3_upload_part_size_multiply_parts_count_threshold
+	CheckCnt              bool   `json:"check_count"`
+	VerifyMode            string `json:"verify_mode"` //local, backup, parts
+	Incremental           bool   //以该分区最新的一次备份为base做增量备份
+	Layout                string `json:"layout"` //S3上的路径模板，如{cluster}/{database}/{table}/{partition}/shard{shard}
+	Upload                bool   //使用原生的s3命令上传
+	DeleteWorkers         int    `json:"delete_workers"` //删除S3上的数据时并发删除的批次数
 }
 
 type Ch struct {
@@ -32,16 +45,79 @@ type Ch struct {
 	Database    string
 	Tables      []string
 	Clean       bool
+	CleanShards bool `json:"clean_verified_shards"` //部分分片备份失败时，是否删除已经校验成功的分片的本地数据
 	ReadTimeout int
 	SshUser     string
 	SshPassword string
 	SshPort     int
+	HostShards  map[string]int    `json:"host_shards"` //早期按照host保存的备份，host到分片编号(从1开始)的映射，用于host下线或ip变更后恢复
+	RestoreAs   map[string]string `json:"restore_as"`  //恢复到其他表，key为备份的表，value为[database.]table
+}
+
+// 恢复的目标表，没有配置restore_as时恢复到原表
+func (c Ch) RestoreTarget(table string) (string, string) {
+	target, ok := c.RestoreAs[table]
+	if !ok || target == "" {
+		return c.Database, table
+	}
+	if i := strings.Index(target, "."); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return c.Database, target
+}
+
+// host所在的分片编号，从1开始，优先使用host_shards中的映射，找不到时返回0
+func (c Ch) ShardOf(host string) int {
+	if shard, ok := c.HostShards[host]; ok {
+		return shard
+	}
+	for i, replicas := range c.Hosts {
+		for _, replica := range replicas {
+			if replica == host {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// 备份保留策略，KeepDays与GFS(Daily/Weekly/Monthly)同时配置时取并集，都不配置表示永久保留
+type Policy struct {
+	KeepDays int `json:"keep_days"` //保留最近N天的备份
+	Daily    int //保留最近N个分区
+	Weekly   int //保留最近N周，每周保留最后一个分区
+	Monthly  int //保留最近N个月，每月保留最后一个分区
+}
+
+func (p Policy) Empty() bool {
+	return p.KeepDays <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+type Retention struct {
+	Policy
+	Tables map[string]Policy //按表覆盖默认的保留策略
+}
+
+func (r Retention) For(table string) Policy {
+	if p, ok := r.Tables[table]; ok {
+		return p
+	}
+	return r.Policy
+}
+
+// 备份时表分区的并发控制，0表示不限制
+type Concurrency struct {
+	Global   int //同时备份的表分区数
+	PerHost  int `json:"per_host"`  //每个clickhouse节点上同时备份的表分区数
+	PerTable int `json:"per_table"` //每张表同时备份的分区数
 }
 
 type Config struct {
-	ClickHouse Ch
-	S3Disk     S3 `json:"s3"`
-	LogLevel   string
+	ClickHouse  Ch
+	S3Disk      S3 `json:"s3"`
+	Retention   Retention
+	Concurrency Concurrency
+	LogLevel    string
 }
 
 func ParseConfig(cwd string) (*Config, error) {
@@ -59,6 +135,10 @@ func ParseConfig(cwd string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if conf.S3Disk.Incremental && conf.S3Disk.VerifyMode == constant.VERIFY_MODE_LOCAL {
+		// 增量备份只上传base中没有的文件，无法与本地文件直接比对
+		return nil, fmt.Errorf("incremental backup requires verify_mode %s or %s", constant.VERIFY_MODE_BACKUP, constant.VERIFY_MODE_PARTS)
+	}
 	return &conf, nil
 }
 
@@ -76,8 +156,17 @@ func setDefaults(conf *Config) {
 	conf.S3Disk.RetryTimes = 1 //不重试
 	conf.S3Disk.UsePathStyle = true
 	conf.S3Disk.CheckSum = false
+	conf.S3Disk.ChecksumMode = constant.CHECKSUM_MODE_ETAG
+	conf.S3Disk.PartSize = 16 * 1024 * 1024
+	conf.S3Disk.SinglePartSize = 32 * 1024 * 1024
+	conf.S3Disk.PartMultiplyFactor = 2
+	conf.S3Disk.PartMultiplyThreshold = 500
+	conf.S3Disk.DeleteWorkers = 8
 	conf.S3Disk.CheckCnt = false
+	conf.S3Disk.VerifyMode = constant.VERIFY_MODE_LOCAL
 	conf.S3Disk.Upload = true
 
+	conf.Concurrency.Global = 1 //默认逐个备份
+
 	conf.LogLevel = "info"
 }
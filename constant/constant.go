@@ -3,12 +3,23 @@ package constant
 const (
 	OP_TYPE_BACKUP  = "backup"
 	OP_TYPE_RESTORE = "restore"
+	OP_TYPE_VERIFY  = "verify"
+	OP_TYPE_DELETE  = "delete"
+	OP_TYPE_PRUNE   = "prune"
 
 	STATE_ROWS              = "rows"
 	STATE_UNCOMPRESSED_SIZE = "buncsize"
 	STATE_COMPRESSED_SIZE   = "bczise"
 	STATE_REMOTE_SIZE       = "rsize"
 
-	BACKUP_SUCCESS = 0
-	BACKUP_FAILURE = 1
+	BACKUP_SUCCESS   = 0
+	BACKUP_FAILURE   = 1
+	BACKUP_CANCELLED = 2 //收到SIGINT/SIGTERM后被取消
+
+	CHECKSUM_MODE_ETAG     = "etag"     //在clickhouse节点上计算分段上传的ETag，与S3上的ETag直接比对
+	CHECKSUM_MODE_DOWNLOAD = "download" //分段上传的对象下载下来计算MD5
+
+	VERIFY_MODE_LOCAL  = "local"  //通过ssh获取clickhouse节点上的本地文件，与S3比对
+	VERIFY_MODE_BACKUP = "backup" //根据BACKUP写入的.backup文件校验，不需要ssh
+	VERIFY_MODE_PARTS  = "parts"  //根据system.parts和system.parts_columns生成文件清单，与S3比对，不需要ssh
 )
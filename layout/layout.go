@@ -0,0 +1,257 @@
+package layout
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 默认的路径模板，按照分片编号保存，host变更后仍然可以恢复
+	DEFAULT_TEMPLATE = "{partition}/{database}.{table}/shard{shard}"
+	MANIFEST_NAME    = "manifest.json"
+	// 与ch.RUN_FORMAT对应
+	runPattern = `\d{8}T\d{6}`
+)
+
+// 路径模板中的变量
+type Vars struct {
+	Cluster   string
+	Database  string
+	Table     string
+	Partition string
+	Run       string
+	Host      string
+	Shard     int //分片编号，从1开始，0表示未知
+}
+
+// S3上的路径模板，最后一级为分片目录，必须包含{host}或{shard}，其余部分为分区目录
+// 一次备份的完整路径为 分区目录/run/分片目录，manifest保存在 分区目录/run/manifest.json
+// 早期版本的备份没有run，分片目录固定为host，即 分区目录/host，manifest保存在 分区目录/manifest.json
+type Layout struct {
+	template string
+	dir      string
+	leaf     string
+	cluster  string
+	re       *regexp.Regexp
+	vars     []string //re中每个分组对应的变量
+	legacyRe *regexp.Regexp
+	legacy   []string //legacyRe中每个分组对应的变量
+}
+
+var (
+	def         *Layout
+	placeholder = regexp.MustCompile(`\{[a-z]+\}`)
+	runOnly     = regexp.MustCompile("^" + runPattern + "$")
+)
+
+func init() {
+	def, _ = New(DEFAULT_TEMPLATE, "")
+}
+
+// 初始化全局的路径模板，template为空时使用默认模板
+func Init(template, cluster string) error {
+	if template == "" {
+		template = DEFAULT_TEMPLATE
+	}
+	l, err := New(template, cluster)
+	if err != nil {
+		return err
+	}
+	def = l
+	return nil
+}
+
+func New(template, cluster string) (*Layout, error) {
+	template = strings.Trim(template, "/")
+	idx := strings.LastIndex(template, "/")
+	if idx < 0 {
+		return nil, fmt.Errorf("layout %s must have at least two levels", template)
+	}
+	l := &Layout{
+		template: template,
+		dir:      template[:idx],
+		leaf:     template[idx+1:],
+		cluster:  cluster,
+	}
+	for _, name := range placeholder.FindAllString(l.dir, -1) {
+		switch name {
+		case "{cluster}", "{database}", "{table}", "{partition}":
+		default:
+			return nil, fmt.Errorf("layout %s: %s is not allowed in partition directory", template, name)
+		}
+	}
+	for _, name := range placeholder.FindAllString(l.leaf, -1) {
+		if name != "{host}" && name != "{shard}" {
+			return nil, fmt.Errorf("layout %s: %s is not allowed in the last level", template, name)
+		}
+	}
+	for _, name := range []string{"{database}", "{table}", "{partition}"} {
+		if !strings.Contains(l.dir, name) {
+			return nil, fmt.Errorf("layout %s must contain %s", template, name)
+		}
+	}
+	if !strings.Contains(l.leaf, "{host}") && !strings.Contains(l.leaf, "{shard}") {
+		return nil, fmt.Errorf("layout %s must contain {host} or {shard} in the last level", template)
+	}
+	if strings.Contains(l.dir, "{cluster}") && cluster == "" {
+		return nil, fmt.Errorf("layout %s contains {cluster}, but cluster is not configured", template)
+	}
+
+	// 将模板转换为正则表达式，用于从S3的key中解析出变量
+	pattern := "^" + l.regexp(l.dir) + `/(` + runPattern + `)/`
+	l.vars = append(l.vars, "{run}")
+	pattern += l.regexp(l.leaf) + `/(.+)$`
+	l.vars = append(l.vars, "{file}")
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	l.re = re
+	vars := l.vars
+	l.vars = nil
+	pattern = "^" + l.regexp(l.dir) + `/` + l.regexp("{host}") + `/(.+)$`
+	l.legacy = append(l.vars, "{file}")
+	l.vars = vars
+	if l.legacyRe, err = regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Layout) regexp(segment string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range placeholder.FindAllStringIndex(segment, -1) {
+		sb.WriteString(regexp.QuoteMeta(segment[last:loc[0]]))
+		name := segment[loc[0]:loc[1]]
+		switch name {
+		case "{cluster}":
+			sb.WriteString(regexp.QuoteMeta(l.cluster))
+		case "{shard}":
+			sb.WriteString(`(\d+)`)
+			l.vars = append(l.vars, name)
+		default:
+			sb.WriteString(`([^/]+?)`)
+			l.vars = append(l.vars, name)
+		}
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(segment[last:]))
+	return sb.String()
+}
+
+func (l *Layout) render(segment string, v Vars) string {
+	return placeholder.ReplaceAllStringFunc(segment, func(name string) string {
+		switch name {
+		case "{cluster}":
+			return l.cluster
+		case "{database}":
+			return v.Database
+		case "{table}":
+			return v.Table
+		case "{partition}":
+			return v.Partition
+		case "{host}":
+			return v.Host
+		case "{shard}":
+			return strconv.Itoa(v.Shard)
+		}
+		return name
+	})
+}
+
+// 分区目录，包含该分区的所有备份
+func (l *Layout) Dir(v Vars) string {
+	return l.render(l.dir, v)
+}
+
+// 一个分片的一次备份，run为空表示早期版本没有run的路径，分片目录为host
+func (l *Layout) Key(v Vars) string {
+	if v.Run == "" {
+		return l.Dir(v) + "/" + v.Host
+	}
+	return l.Dir(v) + "/" + v.Run + "/" + l.render(l.leaf, v)
+}
+
+func (l *Layout) ManifestKey(v Vars) string {
+	if v.Run == "" {
+		return l.Dir(v) + "/" + MANIFEST_NAME
+	}
+	return l.Dir(v) + "/" + v.Run + "/" + MANIFEST_NAME
+}
+
+// 从S3的key中解析出变量，以及分片目录下的文件路径
+func (l *Layout) Parse(key string) (v Vars, file string, ok bool) {
+	vars := l.vars
+	m := l.re.FindStringSubmatch(key)
+	if m == nil {
+		vars = l.legacy
+		if m = l.legacyRe.FindStringSubmatch(key); m == nil {
+			return v, "", false
+		}
+	}
+	v.Cluster = l.cluster
+	for i, name := range vars {
+		value := m[i+1]
+		switch name {
+		case "{database}":
+			if v.Database != "" && v.Database != value {
+				return v, "", false
+			}
+			v.Database = value
+		case "{table}":
+			if v.Table != "" && v.Table != value {
+				return v, "", false
+			}
+			v.Table = value
+		case "{partition}":
+			if v.Partition != "" && v.Partition != value {
+				return v, "", false
+			}
+			v.Partition = value
+		case "{run}":
+			v.Run = value
+		case "{host}":
+			v.Host = value
+		case "{shard}":
+			v.Shard, _ = strconv.Atoi(value)
+		case "{file}":
+			file = value
+		}
+	}
+	if v.Run == "" && runOnly.MatchString(v.Host) {
+		// 分区目录/run/manifest.json
+		return v, "", false
+	}
+	return v, file, true
+}
+
+// 已知变量对应的最长的key前缀，用于缩小遍历的范围，遇到未知的变量时截止
+func (l *Layout) Prefix(v Vars) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range placeholder.FindAllStringIndex(l.dir, -1) {
+		sb.WriteString(l.dir[last:loc[0]])
+		value := l.render(l.dir[loc[0]:loc[1]], v)
+		if value == "" {
+			return sb.String()
+		}
+		sb.WriteString(value)
+		last = loc[1]
+	}
+	sb.WriteString(l.dir[last:])
+	return sb.String() + "/"
+}
+
+func (l *Layout) String() string {
+	return l.template
+}
+
+func Dir(v Vars) string                               { return def.Dir(v) }
+func Key(v Vars) string                               { return def.Key(v) }
+func ManifestKey(v Vars) string                       { return def.ManifestKey(v) }
+func Parse(key string) (v Vars, file string, ok bool) { return def.Parse(key) }
+func Prefix(v Vars) string                            { return def.Prefix(v) }
+func Template() string                                { return def.String() }
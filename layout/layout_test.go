@@ -0,0 +1,67 @@
+package layout
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultLayout(t *testing.T) {
+	l, err := New(DEFAULT_TEMPLATE, "")
+	assert.Nil(t, err)
+	v := Vars{Database: "default", Table: "test_ck_dataq_r77", Partition: "20230731", Host: "192.168.101.93"}
+	assert.Equal(t, "20230731/default.test_ck_dataq_r77/192.168.101.93", l.Key(v))
+	assert.Equal(t, "20230731/default.test_ck_dataq_r77/manifest.json", l.ManifestKey(v))
+	v = Vars{Database: "default", Table: "test_ck_dataq_r77", Partition: "20230731", Run: "20230801T020000", Shard: 1}
+	assert.Equal(t, "20230731/default.test_ck_dataq_r77/20230801T020000/shard1", l.Key(v))
+	assert.Equal(t, "20230731/default.test_ck_dataq_r77/20230801T020000/manifest.json", l.ManifestKey(v))
+	assert.Equal(t, "20230731/default.test_ck_dataq_r77/", l.Prefix(Vars{Database: "default", Table: "test_ck_dataq_r77", Partition: "20230731"}))
+	assert.Equal(t, "20230731/", l.Prefix(Vars{Partition: "20230731"}))
+
+	pv, file, ok := l.Parse(l.Key(v) + "/data/default/test_ck_dataq_r77/20230731_1_1_0/id.bin")
+	assert.True(t, ok)
+	assert.Equal(t, v, pv)
+	assert.Equal(t, "data/default/test_ck_dataq_r77/20230731_1_1_0/id.bin", file)
+
+	pv, file, ok = l.Parse("20230731/default.test_ck_dataq_r77/192.168.101.93/.backup")
+	assert.True(t, ok)
+	assert.Equal(t, "", pv.Run)
+	assert.Equal(t, "192.168.101.93", pv.Host)
+	assert.Equal(t, 0, pv.Shard)
+	assert.Equal(t, ".backup", file)
+
+	_, _, ok = l.Parse(l.ManifestKey(v))
+	assert.False(t, ok)
+	_, _, ok = l.Parse("20230731/default.test_ck_dataq_r77/manifest.json")
+	assert.False(t, ok)
+}
+
+func TestCustomLayout(t *testing.T) {
+	_, err := New("{database}/{table}/shard{shard}", "")
+	assert.NotNil(t, err)
+	_, err = New("{cluster}/{database}/{table}/{partition}/shard{shard}", "")
+	assert.NotNil(t, err)
+	_, err = New("{database}/{table}/{partition}", "")
+	assert.NotNil(t, err)
+
+	l, err := New("prod/{cluster}/{database}/{table}/{partition}/shard{shard}", "abc")
+	assert.Nil(t, err)
+	v := Vars{Cluster: "abc", Database: "default", Table: "t", Partition: "20230731", Run: "20230801T020000", Shard: 2}
+	assert.Equal(t, "prod/abc/default/t/20230731/20230801T020000/shard2", l.Key(v))
+	assert.Equal(t, "prod/abc/default/t/", l.Prefix(Vars{Database: "default", Table: "t"}))
+	assert.Equal(t, "prod/abc/", l.Prefix(Vars{Partition: "20230731"}))
+
+	pv, file, ok := l.Parse(l.Key(v) + "/.backup")
+	assert.True(t, ok)
+	assert.Equal(t, v, pv)
+	assert.Equal(t, ".backup", file)
+	_, _, ok = l.Parse("prod/other/default/t/20230731/20230801T020000/shard2/.backup")
+	assert.False(t, ok)
+
+	l, err = New("{partition}/{database}.{table}/{host}", "")
+	assert.Nil(t, err)
+	v = Vars{Database: "default", Table: "t", Partition: "20230731", Run: "20230801T020000", Host: "192.168.101.93"}
+	pv, _, ok = l.Parse(l.Key(v) + "/.backup")
+	assert.True(t, ok)
+	assert.Equal(t, v, pv)
+}
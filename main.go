@@ -1,27 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
-	"strings"
-	"time"
+	"syscall"
 
 	"github.com/YenchangChan/ch2s3/backup"
+	"github.com/YenchangChan/ch2s3/ch"
 	"github.com/YenchangChan/ch2s3/config"
-	"github.com/YenchangChan/ch2s3/constant"
+	"github.com/YenchangChan/ch2s3/layout"
 	"github.com/YenchangChan/ch2s3/log"
+	"github.com/jessevdk/go-flags"
 )
 
 var (
-	partition = flag.String("p", "", "which partition to backup")
-	ttl       = flag.String("ttl", "", "ttl interval")
-	r         = flag.Bool("restore", false, "restore table")
-
-	op_type    string
 	cwd        string
 	Version    string
 	BuildStamp string
@@ -29,121 +26,109 @@ var (
 )
 
 func main() {
-	conf, err := config.ParseConfig(cwd)
-	if err != nil {
-		fmt.Printf("parse config failed:%v", err)
-		os.Exit(-1)
-	}
-	log.InitLogger(conf.LogLevel, []string{"stdout", "ch2s3.log"})
-	log.Logger.Infof("ch2s3, partition: %s, cwd: %s, version: %s, build timestamp: %s, git hash: %s",
-		*partition, cwd, Version, BuildStamp, Githash)
+	exe, _ := filepath.Abs(os.Args[0])
+	cwd = filepath.Dir(filepath.Dir(exe))
 
-	DumpConfig(conf)
-	current_partition_only := false
-	if *ttl == "" {
-		current_partition_only = true
-	}
-	back := backup.NewBack(conf, op_type, *partition, cwd, current_partition_only)
-	switch op_type {
-	case constant.OP_TYPE_BACKUP:
-		err = ch2s3(back)
-	case constant.OP_TYPE_RESTORE:
-		err = restore(back)
+	parser := flags.NewNamedParser("ch2s3", flags.HelpFlag|flags.PassDoubleDash)
+	for _, c := range commands {
+		if _, err := parser.AddCommand(c.name, c.short, c.long, c.data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
 	}
-	if err != nil {
-		log.Logger.Panic(err)
+	if _, err := parser.Parse(); err != nil {
+		var flagsErr *flags.Error
+		if errors.As(err, &flagsErr) && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(err)
+			return
+		}
+		if log.Logger != nil {
+			log.Logger.Error(err)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(-1)
 	}
-	log.Logger.Infof("backup completed, please see reporter from [%s]!", back.RepoterPath())
 }
 
-func init() {
-	flag.Parse()
-
-	op_type = constant.OP_TYPE_BACKUP
-	if *r {
-		op_type = constant.OP_TYPE_RESTORE
+// 解析配置文件并初始化日志，默认日志输出到stdout和ch2s3.log
+func setup(op_type string, paths ...string) (*config.Config, error) {
+	conf, err := config.ParseConfig(cwd)
+	if err != nil {
+		return nil, fmt.Errorf("parse config failed:%v", err)
 	}
-
-	//指定TTL仅在备份时有效
-	if !*r && *ttl != "" {
-		//指定TTL时，默认按照toYYYYMMDD分区
-		ttlExpr := strings.SplitN(*ttl, " ", 2)
-		interval := ttlExpr[0]
-		unit := strings.ToUpper(ttlExpr[1])
-		var year, month, day int
-		switch unit {
-		case "DAY", "D":
-			if d, err := strconv.Atoi(interval); err == nil {
-				day = d * (-1)
-			}
-		case "WEEK", "W":
-			if w, err := strconv.Atoi(interval); err == nil {
-				day = w * 7 * (-1)
-			}
-		case "MONTH", "M", "MON":
-			if m, err := strconv.Atoi(interval); err == nil {
-				month = m * (-1)
-			}
-		case "YEAR", "Y":
-			if y, err := strconv.Atoi(interval); err == nil {
-				year = y * (-1)
-			}
-		}
-		*partition = time.Now().AddDate(year, month, day).Format("20060102")
+	if len(paths) == 0 {
+		paths = []string{"stdout", "ch2s3.log"}
 	}
-
-	if *partition == "" {
-		*partition = time.Now().Format("20060102")
+	log.InitLogger(conf.LogLevel, paths)
+	if err = layout.Init(conf.S3Disk.Layout, conf.ClickHouse.Cluster); err != nil {
+		return nil, fmt.Errorf("invalid s3 layout: %v", err)
 	}
+	log.Logger.Infof("ch2s3 %s, cwd: %s, version: %s, build timestamp: %s, git hash: %s",
+		op_type, cwd, Version, BuildStamp, Githash)
 
-	exe, _ := filepath.Abs(os.Args[0])
-	cwd = filepath.Dir(filepath.Dir(exe))
+	DumpConfig(conf)
+	backup.Version, backup.Githash = Version, Githash
+	return conf, nil
 }
 
-func ch2s3(back *backup.Backup) error {
-	var err error
-	if err = back.Init(); err != nil {
-		return err
-	}
-	log.Logger.Infof("backup init success!")
-
-	defer back.Stop()
-
-	if err = back.Do(); err != nil {
-		return err
-	}
-
-	log.Logger.Infof("backup to s3 success!")
-
-	if err = back.Repoter(op_type); err != nil {
-		return err
-	}
-
-	log.Logger.Infof("backup reporter success!")
+// 执行一次完整的操作：初始化，执行，出具报表
+// 收到SIGINT/SIGTERM时取消正在执行的操作，仍然出具报表，再次收到信号时直接退出
+func run(back *backup.Backup, op_type string, do func() error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		select {
+		case <-sigs:
+		case <-ctx.Done():
+			// 正常返回，不需要取消
+			return
+		}
+		// 恢复默认处理，再次收到信号时直接退出
+		signal.Stop(sigs)
+		log.Logger.Warnf("%s received signal, cancelling, send the signal again to exit immediately", op_type)
+		cancel()
+		ch.KillUploaders()
+	}()
+	defer func() {
+		signal.Stop(sigs)
+		cancel()
+		<-handled
+	}()
+	back.SetContext(ctx)
 
-	return nil
-}
-func restore(back *backup.Backup) error {
 	var err error
 	if err = back.Init(); err != nil {
 		return err
 	}
-	log.Logger.Infof("restore init success!")
+	log.Logger.Infof("%s init success!", op_type)
 
 	defer back.Stop()
 
-	if err = back.Restore(); err != nil {
+	err = do()
+	if ctx.Err() != nil {
+		if err != nil {
+			log.Logger.Errorf("%s cancelled: %v", op_type, err)
+		}
+		if err = back.Repoter(op_type); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s cancelled, please see reporter from [%s]", op_type, back.RepoterPath())
+	}
+	if err != nil {
 		return err
 	}
 
-	log.Logger.Infof("restore from s3 success!")
+	log.Logger.Infof("%s success!", op_type)
 
 	if err = back.Repoter(op_type); err != nil {
 		return err
 	}
 
-	log.Logger.Infof("restore reporter success!")
-
+	log.Logger.Infof("%s completed, please see reporter from [%s]!", op_type, back.RepoterPath())
 	return nil
 }
 
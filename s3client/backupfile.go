@@ -0,0 +1,177 @@
+package s3client
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/YenchangChan/ch2s3/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-faster/city"
+)
+
+const (
+	BACKUP_METADATA = ".backup"
+	hashBlockSize   = 2048 //与clickhouse的DBMS_DEFAULT_HASHING_BLOCK_SIZE一致
+)
+
+// clickhouse BACKUP写入的.backup文件
+type BackupMetadata struct {
+	XMLName    xml.Name     `xml:"config"`
+	Version    int          `xml:"version"`
+	Timestamp  string       `xml:"timestamp"`
+	UUID       string       `xml:"uuid"`
+	BaseBackup string       `xml:"base_backup"`
+	Files      []BackupFile `xml:"contents>file"`
+}
+
+type BackupFile struct {
+	Name     string `xml:"name"`
+	Size     uint64 `xml:"size"`
+	Checksum string `xml:"checksum"`
+	UseBase  bool   `xml:"use_base"`
+	BaseSize uint64 `xml:"base_size"`
+	DataFile string `xml:"data_file"`
+}
+
+func ReadBackupMetadata(ctx context.Context, bucket, key string) (*BackupMetadata, error) {
+	raw, err := GetObject(ctx, bucket, path.Join(key, BACKUP_METADATA))
+	if err != nil {
+		return nil, err
+	}
+	var meta BackupMetadata
+	if err = xml.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// 根据.backup文件校验S3上的备份：每个文件都存在且大小一致，deep为true时下载文件校验clickhouse记录的checksum
+// 不需要访问clickhouse节点，返回S3上的总大小以及对象个数
+func VerifyBackup(ctx context.Context, bucket, key string, deep bool) (uint64, int, error) {
+	var rsize uint64
+	objects := make(map[string]uint64)
+	err := Walk(ctx, bucket, key+"/", func(item *s3.Object) error {
+		objects[*item.Key] = uint64(*item.Size)
+		rsize += uint64(*item.Size)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(objects) == 0 {
+		return 0, 0, fmt.Errorf("backup %s not found on s3", key)
+	}
+	meta, err := ReadBackupMetadata(ctx, bucket, key)
+	if err != nil {
+		return rsize, len(objects), fmt.Errorf("read %s of %s failed: %v", BACKUP_METADATA, key, err)
+	}
+
+	var lastErr error
+	var mismatch int
+	for _, f := range meta.Files {
+		expect := f.Size
+		if f.UseBase {
+			if f.BaseSize == f.Size {
+				// 整个文件都在base backup中
+				continue
+			}
+			// 只有base backup之后追加的部分在本次备份中
+			expect = f.Size - f.BaseSize
+		}
+		if expect == 0 {
+			continue
+		}
+		name := f.Name
+		if f.DataFile != "" {
+			name = f.DataFile
+		}
+		okey := path.Join(key, name)
+		size, ok := objects[okey]
+		if !ok {
+			lastErr = fmt.Errorf("file %s not found on s3", okey)
+			log.Logger.Warnf("%v", lastErr)
+			mismatch++
+			continue
+		}
+		if size != expect {
+			lastErr = fmt.Errorf("size mismatch for %s, expect %d, but got %d", okey, expect, size)
+			log.Logger.Warnf("%v", lastErr)
+			mismatch++
+			continue
+		}
+		if deep && !f.UseBase && f.Checksum != "" {
+			checksum, err := ObjectChecksum(ctx, bucket, okey)
+			if err != nil {
+				return rsize, len(objects), err
+			}
+			if checksum != f.Checksum {
+				lastErr = fmt.Errorf("checksum mismatch for %s, expect %s, but got %s", okey, f.Checksum, checksum)
+				log.Logger.Warnf("%v", lastErr)
+				mismatch++
+			}
+		}
+	}
+	log.Logger.Infof("%s has %d files in %s, %d objects on s3, %d mismatch", key, len(meta.Files), BACKUP_METADATA, len(objects), mismatch)
+	return rsize, len(objects), lastErr
+}
+
+// 下载对象，按照clickhouse的方式计算checksum
+func ObjectChecksum(ctx context.Context, bucket, key string) (string, error) {
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+	h := &chHasher{}
+	if _, err = io.Copy(h, output.Body); err != nil {
+		return "", err
+	}
+	return h.Hex(), nil
+}
+
+// 与clickhouse的HashingReadBuffer一致：按2048字节分块，以上一块的结果作为种子计算CityHash128
+type chHasher struct {
+	state city.U128
+	buf   [hashBlockSize]byte
+	pos   int
+}
+
+func (h *chHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	if h.pos+len(p) < hashBlockSize {
+		h.pos += copy(h.buf[h.pos:], p)
+		return n, nil
+	}
+	if h.pos > 0 {
+		m := copy(h.buf[h.pos:], p)
+		h.state = city.CH128Seed(h.buf[:], h.state)
+		p = p[m:]
+		h.pos = 0
+	}
+	for len(p) >= hashBlockSize {
+		h.state = city.CH128Seed(p[:hashBlockSize], h.state)
+		p = p[hashBlockSize:]
+	}
+	h.pos = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *chHasher) Sum() city.U128 {
+	if h.pos > 0 {
+		return city.CH128Seed(h.buf[:h.pos], h.state)
+	}
+	return h.state
+}
+
+// 与clickhouse的getHexUIntLowercase(UInt128)一致，高64位在前
+func (h *chHasher) Hex() string {
+	sum := h.Sum()
+	return fmt.Sprintf("%016x%016x", sum.High, sum.Low)
+}
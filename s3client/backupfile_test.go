@@ -0,0 +1,63 @@
+package s3client
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+
+	"github.com/go-faster/city"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChHasher(t *testing.T) {
+	data := bytes.Repeat([]byte("clickhouse"), 1000) // 10000 bytes
+
+	// 小于一个块时即为以0为种子的CityHash128
+	h := &chHasher{}
+	h.Write(data[:100])
+	assert.Equal(t, city.CH128Seed(data[:100], city.U128{}), h.Sum())
+
+	// 分多次写入与一次写入结果一致
+	whole := &chHasher{}
+	whole.Write(data)
+	chunked := &chHasher{}
+	for _, n := range []int{1, 2047, 2048, 3000, 10000} {
+		if n > len(data) {
+			n = len(data)
+		}
+		chunked.Write(data[:n])
+		data = data[n:]
+	}
+	assert.Equal(t, whole.Hex(), chunked.Hex())
+	assert.Len(t, whole.Hex(), 32)
+}
+
+func TestBackupMetadata(t *testing.T) {
+	raw := `<?xml version="1.0"?>
+<config>
+    <version>1</version>
+    <timestamp>2023-07-31 02:00:00</timestamp>
+    <uuid>9c4ad3f8-2b06-4a1d-9a6b-4b3b8a0e9d9f</uuid>
+    <contents>
+        <file>
+            <name>metadata/default/t.sql</name>
+            <size>420</size>
+            <checksum>0e5c6b3c4f4d5a0b8ed6d2a3c1a0b9f1</checksum>
+        </file>
+        <file>
+            <name>data/default/t/20230731_1_1_0/count.txt</name>
+            <size>3</size>
+            <checksum>a1b2c3d4e5f60718293a4b5c6d7e8f90</checksum>
+            <use_base>true</use_base>
+            <base_size>3</base_size>
+        </file>
+    </contents>
+</config>`
+	var meta BackupMetadata
+	assert.Nil(t, xml.Unmarshal([]byte(raw), &meta))
+	assert.Equal(t, 1, meta.Version)
+	assert.Len(t, meta.Files, 2)
+	assert.Equal(t, uint64(420), meta.Files[0].Size)
+	assert.True(t, meta.Files[1].UseBase)
+	assert.Equal(t, uint64(3), meta.Files[1].BaseSize)
+}
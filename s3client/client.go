@@ -1,6 +1,7 @@
 package s3client
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
@@ -11,6 +12,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/YenchangChan/ch2s3/config"
@@ -25,6 +27,11 @@ import (
 	_ "github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+const (
+	DeleteBatchSize = 1000             //DeleteObjects一次最多删除1000个key
+	CleanupTimeout  = 10 * time.Minute //取消之后清理不完整的数据的超时时间
+)
+
 var (
 	svc *s3.S3
 	sc  *session.Session
@@ -60,55 +67,185 @@ func NewSession(conf *config.S3) error {
 	return nil
 }
 
-func Remove(bucket, key string) error {
-	params := &s3.ListObjectsInput{
+// 检查bucket是否可以访问
+func CheckBucket(ctx context.Context, bucket string) error {
+	_, err := svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	return err
+}
+
+// 遍历prefix下的所有对象, 通过continuation token自动翻页, 不受单次1000个key的限制
+// 所有的列举操作都应该通过Walk进行
+func Walk(ctx context.Context, bucket, prefix string, fn func(object *s3.Object) error) error {
+	var walkErr error
+	err := svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(key),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if walkErr = fn(item); walkErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
 	}
-	resp, err := svc.ListObjects(params)
+	return walkErr
+}
+
+// 遍历prefix下的一级子目录(CommonPrefixes)，不列举子目录中的对象
+func WalkPrefixes(ctx context.Context, bucket, prefix string, fn func(prefix string) error) error {
+	var walkErr error
+	err := svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.CommonPrefixes {
+			if walkErr = fn(*item.Prefix); walkErr != nil {
+				return false
+			}
+		}
+		return true
+	})
 	if err != nil {
 		return err
 	}
-LOOP_DEL:
-	log.Logger.Infof("key %s has %d objects need to delete", key, len(resp.Contents))
-	for _, item := range resp.Contents {
-		log.Logger.Debugf("%s need to delete", *item.Key)
-		_, err := svc.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    item.Key,
-		})
-		if err != nil {
-			log.Logger.Errorf("delete %s failed", *item.Key)
-			return err
-		} else {
-			err = svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+	return walkErr
+}
+
+// 列出prefix下的所有对象
+func List(ctx context.Context, bucket, prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := Walk(ctx, bucket, prefix, func(object *s3.Object) error {
+		objects = append(objects, object)
+		return nil
+	})
+	return objects, err
+}
+
+// 上传一个小对象，如manifest
+func PutObject(ctx context.Context, bucket, key string, body []byte) error {
+	_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+// 下载一个小对象，如manifest
+func GetObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+// 对象不存在
+func IsNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+// 删除prefix下的所有对象，每批最多1000个key，多批并发删除，全部删除后统一校验一次
+
+// 删除失败或被取消的备份留下的不完整的数据，不受取消的影响
+func Cleanup(bucket, key string, workers int) error {
+	c, cancel := context.WithTimeout(context.Background(), CleanupTimeout)
+	defer cancel()
+	return Remove(c, bucket, key, workers)
+}
+
+// 删除prefix下的所有对象，每批最多1000个key，多批并发删除，全部删除后统一校验一次
+func Remove(ctx context.Context, bucket, key string, workers int) error {
+	var batches [][]*s3.ObjectIdentifier
+	var batch []*s3.ObjectIdentifier
+	err := Walk(ctx, bucket, key, func(item *s3.Object) error {
+		batch = append(batch, &s3.ObjectIdentifier{Key: item.Key})
+		if len(batch) == DeleteBatchSize {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	if len(batches) == 0 {
+		log.Logger.Infof("object %s is empty", key)
+		return nil
+	}
+	log.Logger.Infof("key %s has %d objects need to delete, %d batches", key, (len(batches)-1)*DeleteBatchSize+len(batches[len(batches)-1]), len(batches))
+
+	var lock sync.Mutex
+	var failed int
+	var lastErr error
+	if workers < 1 {
+		workers = 1
+	}
+	pool := utils.NewWorkerPool(workers, 2*workers)
+	for _, batch := range batches {
+		objects := batch
+		pool.Submit(func() {
+			resp, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
 				Bucket: aws.String(bucket),
-				Key:    item.Key,
+				Delete: &s3.Delete{
+					Objects: objects,
+					Quiet:   aws.Bool(true),
+				},
 			})
+			lock.Lock()
+			defer lock.Unlock()
 			if err != nil {
-				log.Logger.Errorf("delete %s failed", *item.Key)
-				return err
+				log.Logger.Errorf("delete %d objects from %s failed: %v", len(objects), *objects[0].Key, err)
+				failed += len(objects)
+				lastErr = err
+				return
 			}
-			log.Logger.Debugf("%s deleted", *item.Key)
-		}
+			//Quiet模式下只返回删除失败的key
+			for _, e := range resp.Errors {
+				log.Logger.Errorf("delete %s failed: %s, %s", aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+				failed++
+				lastErr = fmt.Errorf("delete %s failed: %s", aws.StringValue(e.Key), aws.StringValue(e.Message))
+			}
+			log.Logger.Debugf("%d objects deleted from %s", len(objects)-len(resp.Errors), *objects[0].Key)
+		})
+	}
+	pool.Close()
+	if lastErr != nil {
+		return fmt.Errorf("%d objects of %s delete failed, last error: %v", failed, key, lastErr)
 	}
 
-	//由于一次最多只能删除1000个object，删除之后查一把还有没有没删除的
-	resp, err = svc.ListObjects(params)
+	remained := 0
+	err = Walk(ctx, bucket, key, func(item *s3.Object) error {
+		remained++
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if len(resp.Contents) == 0 {
-		log.Logger.Infof("object %s is empty", key)
-	} else {
-		//没删除干净，再来一次
-		log.Logger.Infof("object %s is not empty, still %d objects remained, try again", key, len(resp.Contents))
-		goto LOOP_DEL
+	if remained > 0 {
+		return fmt.Errorf("object %s is not empty, still %d objects remained", key, remained)
 	}
+	log.Logger.Infof("object %s is empty", key)
 	return nil
 }
 
-func CheckSum(host string, bucket, key string, paths map[string]utils.PathInfo, conf config.S3) (map[string]utils.PathInfo, uint64, int, error) {
+func CheckSum(ctx context.Context, host string, bucket, key string, paths map[string]utils.PathInfo, conf config.S3) (map[string]utils.PathInfo, uint64, int, error) {
 	var rsize uint64
 	errPaths := make(map[string]utils.PathInfo)
 
@@ -128,27 +265,28 @@ func CheckSum(host string, bucket, key string, paths map[string]utils.PathInfo,
 	rcnts := make(map[string]int)
 	cnt := 0
 	for subkey := range subKeys {
-		params := &s3.ListObjectsInput{
-			Bucket: aws.String(bucket),
-			Prefix: aws.String(subkey),
-		}
-		resp, err := svc.ListObjects(params)
-		if err != nil {
-			return errPaths, rsize, -1, err
-		}
-
 		subCnt := 0
-		for _, item := range resp.Contents {
+		// 以"/"结尾，避免匹配到同前缀的其他part, 如 20230731_1_1_0 与 20230731_1_1_0_5
+		err := Walk(ctx, bucket, subkey+"/", func(item *s3.Object) error {
 			checksum := strings.Trim(*item.ETag, "\"")
+			if local, ok := paths[*item.Key]; ok && strings.Contains(checksum, "-") && conf.CheckSum && local.ETag != "" {
+				//分段上传, 与clickhouse节点上按照相同分段策略计算出的ETag比对，一致则无需下载
+				if local.ETag == checksum {
+					log.Logger.Debugf("key %s is multipart upload, etag %s matched", *item.Key, checksum)
+					checksum = local.MD5
+				} else {
+					log.Logger.Warnf("key %s is multipart upload, etag mismatch, expect %s, but got %s, try to download", *item.Key, local.ETag, checksum)
+				}
+			}
 			if strings.Contains(checksum, "-") && conf.CheckSum {
-				//分段上传, 由于不知道UploadId, 无法计算具体的MD5值, 需要将对象下载下来，分段计算MD5
+				//分段上传, 由于不知道UploadId, 无法计算具体的MD5值, 需要将对象下载下来，分段计算MD5, 作为最后的手段
 				log.Logger.Infof("key %s is multipart upload, checksum: %s", *item.Key, checksum)
-				output, err := svc.GetObject(&s3.GetObjectInput{
+				output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 					Bucket: aws.String(bucket),
 					Key:    item.Key,
 				})
 				if err != nil {
-					return errPaths, rsize, -1, err
+					return err
 				}
 				defer output.Body.Close()
 				//一次读取32MB
@@ -157,7 +295,7 @@ func CheckSum(host string, bucket, key string, paths map[string]utils.PathInfo,
 				for {
 					n, err := output.Body.Read(segment)
 					if err != nil && err != io.EOF {
-						return errPaths, rsize, -1, err
+						return err
 					}
 					if n == 0 {
 						break
@@ -171,13 +309,14 @@ func CheckSum(host string, bucket, key string, paths map[string]utils.PathInfo,
 			subCnt++
 			rpaths[*item.Key] = checksum
 			log.Logger.Debugf("[%s]remote s3 path: %s, checksum: %s", host, *item.Key, checksum)
+			return nil
+		})
+		if err != nil {
+			return errPaths, rsize, -1, err
 		}
 		log.Logger.Infof("[%s] %s remote count: %d", host, subkey, subCnt)
 		cnt += subCnt
 		rcnts[subkey+"/"] = subCnt
-		if subCnt == 1000 {
-			log.Logger.Warnf("NOTICE: %s has more than 1000 keys, may not list all.", subkey)
-		}
 	}
 	log.Logger.Infof("[%s] %s remote total count: %d", host, key, cnt)
 	var err error
@@ -213,7 +352,7 @@ func CheckSum(host string, bucket, key string, paths map[string]utils.PathInfo,
 	return errPaths, rsize, cnt, err
 }
 
-func Upload(bucket, folderPath, key string, dryrun bool) error {
+func Upload(ctx context.Context, bucket, folderPath, key string, dryrun bool) error {
 	pool := utils.NewPoolDefault()
 	var lastErr error
 	defer pool.Close()
@@ -229,7 +368,7 @@ func Upload(bucket, folderPath, key string, dryrun bool) error {
 
 		if !info.IsDir() {
 			pool.Submit(func() {
-				if err := uploadFile(key, fpath, bucket, dryrun); err != nil {
+				if err := uploadFile(ctx, key, fpath, bucket, dryrun); err != nil {
 					lastErr = err
 					return
 				}
@@ -256,7 +395,7 @@ func Upload(bucket, folderPath, key string, dryrun bool) error {
 	return nil
 }
 
-func uploadFile(key, fpath, bucket string, dryrun bool) error {
+func uploadFile(ctx context.Context, key, fpath, bucket string, dryrun bool) error {
 	skey := path.Join(key, filepath.Base(fpath))
 	if !dryrun {
 		file, err := os.Open(fpath)
@@ -265,7 +404,7 @@ func uploadFile(key, fpath, bucket string, dryrun bool) error {
 			return err
 		}
 		defer file.Close()
-		_, err = svc.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+		_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(skey),
 			Body:   file,
@@ -1,6 +1,7 @@
 package s3client
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -34,6 +35,6 @@ func TestS3(t *testing.T) {
 		fmt.Printf("* %s created on %s\n",
 			aws.StringValue(b.Name), aws.TimeValue(b.CreationDate))
 	}
-	err = Remove("backup", "19700101/default.test_ck_dataq_r50/192.168.101.93")
+	err = Remove(context.Background(), "backup", "19700101/default.test_ck_dataq_r50/192.168.101.93", 8)
 	assert.Nil(t, err)
 }
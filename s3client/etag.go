@@ -0,0 +1,75 @@
+package s3client
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/YenchangChan/ch2s3/config"
+)
+
+const (
+	MaxPartSize = 5 * 1024 * 1024 * 1024 //对应clickhouse的s3_max_upload_part_size
+)
+
+// 计算文件上传到S3后的ETag，同时返回整个文件的MD5
+// clickhouse BACKUP上传文件时，小于等于SinglePartSize的文件直接上传，ETag即为MD5；
+// 否则从PartSize开始分段上传，每上传PartMultiplyThreshold段，段大小乘以PartMultiplyFactor，
+// ETag为每段MD5拼接后的MD5加上"-段数"
+func ETag(r io.Reader, size int64, conf config.S3) (string, string, error) {
+	whole := md5.New()
+	if size <= conf.SinglePartSize {
+		if _, err := io.Copy(whole, r); err != nil {
+			return "", "", err
+		}
+		sum := hex.EncodeToString(whole.Sum(nil))
+		return sum, sum, nil
+	}
+	partSize := conf.PartSize
+	var parts int
+	composite := md5.New()
+	for written := int64(0); written < size; written += partSize {
+		partSize = nextPartSize(partSize, parts, conf)
+		part := md5.New()
+		n, err := io.CopyN(io.MultiWriter(part, whole), r, partSize)
+		if err != nil && err != io.EOF {
+			return "", "", err
+		}
+		if n == 0 {
+			break
+		}
+		composite.Write(part.Sum(nil))
+		parts++
+	}
+	return hex.EncodeToString(whole.Sum(nil)), fmt.Sprintf("%s-%d", hex.EncodeToString(composite.Sum(nil)), parts), nil
+}
+
+func FileETag(fpath string, conf config.S3) (string, string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	return ETag(f, info.Size(), conf)
+}
+
+// 已经上传了parts段之后下一段的大小，与clickhouse的WriteBufferFromS3一致：
+// 每上传PartMultiplyThreshold段，段大小乘以PartMultiplyFactor，最大不超过MaxPartSize
+func nextPartSize(partSize int64, parts int, conf config.S3) int64 {
+	if parts == 0 || conf.PartMultiplyThreshold <= 0 || conf.PartMultiplyFactor <= 1 {
+		return partSize
+	}
+	if parts%conf.PartMultiplyThreshold == 0 {
+		partSize *= conf.PartMultiplyFactor
+		if partSize > MaxPartSize {
+			partSize = MaxPartSize
+		}
+	}
+	return partSize
+}
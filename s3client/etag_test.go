@@ -0,0 +1,70 @@
+package s3client
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/YenchangChan/ch2s3/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	data := bytes.Repeat([]byte("ch2s3"), 5000) // 25000 bytes
+	whole := md5.Sum(data)
+	expectMD5 := hex.EncodeToString(whole[:])
+
+	// 单段上传，ETag即为MD5
+	md5sum, etag, err := ETag(bytes.NewReader(data), int64(len(data)), config.S3{PartSize: 1024, SinglePartSize: int64(len(data))})
+	assert.Nil(t, err)
+	assert.Equal(t, expectMD5, md5sum)
+	assert.Equal(t, expectMD5, etag)
+
+	// 分段上传，每段10000字节，共3段
+	var composite []byte
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[i:end])
+		composite = append(composite, sum[:]...)
+	}
+	sum := md5.Sum(composite)
+	md5sum, etag, err = ETag(bytes.NewReader(data), int64(len(data)), config.S3{PartSize: 10000, SinglePartSize: 1024})
+	assert.Nil(t, err)
+	assert.Equal(t, expectMD5, md5sum)
+	assert.Equal(t, fmt.Sprintf("%s-3", hex.EncodeToString(sum[:])), etag)
+}
+
+func TestETagMultiplyPartSize(t *testing.T) {
+	// 前500段每段10字节，之后每段20字节，共600段
+	data := bytes.Repeat([]byte("ch2s3"), 1400) // 7000 bytes
+	var composite []byte
+	for i, parts := 0, 0; i < len(data); parts++ {
+		size := 10
+		if parts >= 500 {
+			size = 20
+		}
+		sum := md5.Sum(data[i : i+size])
+		composite = append(composite, sum[:]...)
+		i += size
+	}
+	sum := md5.Sum(composite)
+	conf := config.S3{PartSize: 10, SinglePartSize: 10, PartMultiplyFactor: 2, PartMultiplyThreshold: 500}
+	_, etag, err := ETag(bytes.NewReader(data), int64(len(data)), conf)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%s-600", hex.EncodeToString(sum[:])), etag)
+}
+
+func TestNextPartSize(t *testing.T) {
+	conf := config.S3{PartMultiplyFactor: 2, PartMultiplyThreshold: 500}
+	assert.Equal(t, int64(16), nextPartSize(16, 0, conf))
+	assert.Equal(t, int64(16), nextPartSize(16, 499, conf))
+	assert.Equal(t, int64(32), nextPartSize(16, 500, conf))
+	assert.Equal(t, int64(MaxPartSize), nextPartSize(MaxPartSize, 1000, conf))
+	// 未配置时不增大段大小
+	assert.Equal(t, int64(16), nextPartSize(16, 500, config.S3{}))
+}
@@ -5,5 +5,6 @@ type PathInfo struct {
 	RPath string
 	LPath string
 	MD5   string
+	ETag  string //按照分段上传策略计算出的ETag
 	Cnt   int
 }